@@ -6,9 +6,7 @@ require (
 	github.com/kylelemons/godebug v1.1.0
 	github.com/pmezard/go-difflib v1.0.0
 	github.com/stretchr/testify v1.7.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
-require (
-	github.com/davecgh/go-spew v1.1.0 // indirect
-	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c // indirect
-)
+require github.com/davecgh/go-spew v1.1.0 // indirect
@@ -9,6 +9,7 @@
 //
 //	20 is too large!
 //
+//	goroutine 7 at 2017-06-01T12:00:00.000120Z
 //	main.Foo
 //	  github.com/samsarahq/go/oops/example/main.go:12
 //	main.Legacy
@@ -18,6 +19,7 @@
 //	main.Go.func1
 //	  github.com/samsarahq/go/oops/example/main.go:35
 //
+//	goroutine 1 at 2017-06-01T12:00:00.000165Z (+45.2µs)
 //	main.Go: goroutine had a problem
 //	  github.com/samsarahq/go/oops/example/main.go:38
 //	main.main
@@ -30,12 +32,24 @@
 // call oops.Wrapf every time you return an error. If you have no context to
 // add, you can always pass an empty format string to oops.Wrapf.
 //
+// Each stacktrace starts with the goroutine it was captured on and when it was
+// captured, which is helpful when an error crosses goroutines. oops.Stacks
+// returns the same information. Earlier versions of oops did not print this
+// header, and because of it the output of Error now differs every time an
+// error is created, so tests should compare errors with oops.Cause or errors.Is
+// rather than by their full output.
+//
 // When adding oops to an existing package or program, you might have
 // intermediate functions that don't yet call oops.Wrapf when returning errors.
 // That is no problem, as later calls to oops.Wrapf will attach their messages
 // to right stackframe. However, you might as well add oops.Wrapf there as
 // well!
 //
+// For sentinel and expected errors that should not pay for capturing a
+// stacktrace, use oops.Lightf and oops.LightWrapf. These errors carry reasons
+// and metadata, and capture a stacktrace the first time oops.Wrapf is called on
+// them.
+//
 // Usage:
 //
 //	package main
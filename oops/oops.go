@@ -4,11 +4,14 @@
 package oops
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"runtime"
 	"strconv"
 	"strings"
 	"sync/atomic"
+	"time"
 )
 
 // filePrefixesToShortCircuit is a set of prefixes of files which, when encountered when serializing
@@ -44,9 +47,19 @@ func GetPrefixesToShortCircuit() []string {
 	return prefixes
 }
 
+// stackTimeFormat is the format of the capture time in the header of each stack.
+const stackTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
 // stack is a comparable []uintptr slice.
 type stack struct {
 	frames []uintptr
+	// header is the start of the header written by runtime.Stack for the
+	// goroutine the stack was captured on, e.g. "goroutine 18 [running]:". The
+	// goroutine ID is only parsed from it when the stack is formatted.
+	header [goroutineHeaderSize]byte
+	// time is when the stack was captured. It includes a monotonic clock reading,
+	// so durations between stacks are accurate.
+	time time.Time
 }
 
 // A oopsError annotates a cause error with a stacktrace and an explanatory
@@ -66,6 +79,9 @@ type oopsError struct {
 	// metadata is a map of additional information included in the error.
 	// calling CollectMetadata() on an `oopsError` will return the aggregated metadata from the entire chain.
 	metadata map[string]interface{}
+	// deferred is an error returned by a deferred call, such as Close, while this error was being returned. It is
+	// retained alongside the primary error instead of replacing it.
+	deferred *oopsError
 }
 
 // Error implements error and outputs a full backtrace.
@@ -96,8 +112,9 @@ func CollectMetadata(err error) map[string]interface{} {
 	return metadata
 }
 
-// MainStackToString writes the frames of the main goroutine to a string.
-// It returns an empty string if the error is not an oopsError.
+// MainStackToString writes the frames of the main goroutine to a string, with
+// the same header as in Error. It returns an empty string if the error is not an
+// oopsError.
 func MainStackToString(err error) string {
 	var e *oopsError
 	if ok := As(err, &e); !ok {
@@ -111,15 +128,33 @@ func MainStackToString(err error) string {
 	var b strings.Builder
 	b.WriteString(base.Error())
 
-	frames, skipInfo := framesWithSkipInfo(err)
-	if frames == nil || len(frames) == 0 {
+	stacks := parseStacks(err)
+	if len(stacks) == 0 {
 		return ""
 	}
 	b.WriteString("\n\n")
-	writeSingleFrameTrace(&b, frames[0], skipInfo[0])
+	if stacks[0].stack != nil {
+		writeStackHeader(&b, stacks[0].stack, stacks[0].stack)
+	}
+	writeSingleFrameTrace(&b, stacks[0].frames, stacks[0].framesSkipped)
 	return b.String()
 }
 
+// writeStackHeader writes the goroutine and capture time of st into the string builder. When st is not the first stack
+// in the trace, the time elapsed since the first stack was captured is included as well.
+func writeStackHeader(b *strings.Builder, st *stack, first *stack) {
+	b.WriteString("goroutine ")
+	b.WriteString(strconv.FormatInt(st.goroutineID(), 10))
+	b.WriteString(" at ")
+	b.WriteString(st.time.Format(stackTimeFormat))
+	if st != first {
+		b.WriteString(" (+")
+		b.WriteString(st.time.Sub(first.time).String())
+		b.WriteRune(')')
+	}
+	b.WriteRune('\n')
+}
+
 // writeSingleFrameTrace writes the stack trace of frames into the string builder.
 func writeSingleFrameTrace(b *strings.Builder, frames []Frame, framesSkipped bool) {
 	for _, frame := range frames {
@@ -156,23 +191,127 @@ func (err *oopsError) Unwrap() error {
 	return nil
 }
 
+// Is reports whether target is an oops error in err's chain of previous oops
+// errors. Because Unwrap skips over oops errors, this lets errors.Is match
+// sentinel errors created with Lightf after they have been wrapped.
+func (err *oopsError) Is(target error) bool {
+	for e := err; e != nil; e = e.previous {
+		if error(e) == target {
+			return true
+		}
+	}
+	for _, deferred := range err.deferredErrors() {
+		if Is(deferred, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first error matching target in the errors returned by deferred calls while err was being returned.
+// The primary error chain takes precedence over deferred errors.
+func (err *oopsError) As(target interface{}) bool {
+	deferred := err.deferredErrors()
+	if len(deferred) == 0 {
+		return false
+	}
+	if err.inner != nil && As(err.inner, target) {
+		return true
+	}
+	for _, d := range deferred {
+		if As(d, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// deferredErrors returns the errors returned by deferred calls in err's chain of oops errors, starting with the
+// earliest one.
+func (err *oopsError) deferredErrors() []*oopsError {
+	var deferred []*oopsError
+	for e := err; e != nil; e = e.previous {
+		if e.deferred != nil {
+			deferred = append(deferred, e.deferred)
+		}
+	}
+	for i, j := 0, len(deferred)-1; i < j; i, j = i+1, j-1 {
+		deferred[i], deferred[j] = deferred[j], deferred[i]
+	}
+	return deferred
+}
+
 type stackWithReasons struct {
 	stack   *stack
 	reasons []string
 }
 
+// parsedStack is a stack along with its parsed frames.
+type parsedStack struct {
+	stack  *stack
+	frames []Frame
+	// framesSkipped is whether frames were skipped because of a prefix to short-circuit.
+	framesSkipped bool
+	// reasons has the same length as stack.frames, and holds the reason added at each frame.
+	reasons []string
+	// base is the base error of the chain of oops errors the stack belongs to.
+	base error
+}
+
 // framesWithSkipInfo returns a slice of stack frames, along with whether or not there were frames that were skipped when
 // they were appended to each slice. The returned slices are guaranteed to have the same number of elements.
 func framesWithSkipInfo(err error) ([][]Frame, []bool) {
+	stacks := parseStacks(err)
+	if stacks == nil {
+		return nil, nil
+	}
+
+	frames := make([][]Frame, 0, len(stacks))
+	skipInfo := make([]bool, 0, len(stacks))
+	for _, stack := range stacks {
+		frames = append(frames, stack.frames)
+		skipInfo = append(skipInfo, stack.framesSkipped)
+	}
+	return frames, skipInfo
+}
+
+// parseStacks returns the parsed stacks of the first oops error in err's chain. Stacks of errors returned by deferred
+// calls follow the stacks of the primary error. If err is not an oops error or has no stacks, such as a chain of
+// lightweight errors, nil is returned.
+func parseStacks(err error) []parsedStack {
 	var e *oopsError
 	if ok := As(err, &e); !ok {
-		return nil, nil
+		return nil
 	}
 
+	parsedStacks := parseChainStacks(e)
+	for _, deferred := range e.deferredErrors() {
+		parsedStacks = append(parsedStacks, parseStacks(deferred)...)
+	}
+	if len(parsedStacks) == 0 {
+		return nil
+	}
+	return parsedStacks
+}
+
+// parseChainStacks is like parseStacks, but only includes the stacks of e's chain of oops errors.
+func parseChainStacks(e *oopsError) []parsedStack {
+	base := e.base()
+
 	// Walk the chain of oopsErrors backwards, collecting a set of stacks and
 	// reasons.
 	stacks := make([]stackWithReasons, 0, 8)
+	var lastIndex int
 	for ; e != nil; e = e.previous {
+		// Lightweight errors don't have a stack of their own. Attach their
+		// reasons to the frame where the chain was upgraded by Wrapf.
+		if e.stack == nil {
+			if len(stacks) > 0 {
+				reasons := stacks[len(stacks)-1].reasons
+				reasons[lastIndex] = joinReasons(reasons[lastIndex], e.reason)
+			}
+			continue
+		}
 		// If the current error's stack is different from the previous, add it to
 		// the set of stacks.
 		if len(stacks) == 0 || stacks[len(stacks)-1].stack != e.stack {
@@ -182,11 +321,12 @@ func framesWithSkipInfo(err error) ([][]Frame, []bool) {
 			})
 		}
 		// Store the reason with its stack frame.
-		stacks[len(stacks)-1].reasons[e.index] = e.reason
+		reasons := stacks[len(stacks)-1].reasons
+		reasons[e.index] = joinReasons(reasons[e.index], e.reason)
+		lastIndex = e.index
 	}
 
-	parsedStacks := make([][]Frame, 0, len(stacks))
-	skippedFramesInStack := make([]bool, 0, len(stacks))
+	parsedStacks := make([]parsedStack, 0, len(stacks))
 
 	// Load the prefixes to short circuit so we don't do it within a loop.
 	filePrefixesToSkipMap := filePrefixesToShortCircuit.Load().(map[string]struct{})
@@ -244,10 +384,27 @@ func framesWithSkipInfo(err error) ([][]Frame, []bool) {
 				Reason:   reason,
 			})
 		}
-		parsedStacks = append(parsedStacks, parsedFrames)
-		skippedFramesInStack = append(skippedFramesInStack, framesSkipped)
+		parsedStacks = append(parsedStacks, parsedStack{
+			stack:         stacks[i].stack,
+			frames:        parsedFrames,
+			framesSkipped: framesSkipped,
+			reasons:       reasons,
+			base:          base,
+		})
+	}
+	return parsedStacks
+}
+
+// joinReasons joins an outer and an inner reason the same way Reason does,
+// skipping empty reasons.
+func joinReasons(outer, inner string) string {
+	if outer == "" {
+		return inner
 	}
-	return parsedStacks, skippedFramesInStack
+	if inner == "" {
+		return outer
+	}
+	return outer + ": " + inner
 }
 
 func mapContainsKeyWithPrefix(filePrefixesToSkipMap map[string]struct{}, file string) bool {
@@ -260,12 +417,38 @@ func mapContainsKeyWithPrefix(filePrefixesToSkipMap map[string]struct{}, file st
 }
 
 // Frames extracts all frames from an oops error. If err is not an oops error,
-// nil is returned.
+// or only consists of lightweight errors without a stacktrace, nil is returned. Use Stacks to also get information about each stack.
 func Frames(err error) [][]Frame {
 	frames, _ := framesWithSkipInfo(err)
 	return frames
 }
 
+// Stacks extracts all stacks from an oops error. Unlike Frames, each Stack also
+// includes whether its frames were truncated, its base error and reasons, and
+// the raw program counters for use with external symbolizers. If err is not an
+// oops error, or has no stacktrace, nil is returned.
+func Stacks(err error) []Stack {
+	parsedStacks := parseStacks(err)
+	if parsedStacks == nil {
+		return nil
+	}
+	stacks := make([]Stack, 0, len(parsedStacks))
+	for _, parsed := range parsedStacks {
+		pcs := make([]uintptr, len(parsed.stack.frames))
+		copy(pcs, parsed.stack.frames)
+		stacks = append(stacks, Stack{
+			Frames:      parsed.frames,
+			Truncated:   parsed.framesSkipped,
+			Base:        parsed.base,
+			Reasons:     parsed.reasons,
+			PCs:         pcs,
+			GoroutineID: parsed.stack.goroutineID(),
+			Time:        parsed.stack.time,
+		})
+	}
+	return stacks
+}
+
 // SkipFrames skips numFrames from the stack trace and returns a new copy of the error.
 // If numFrames is greater than the number of frames in err, SkipFrames will do nothing and return the original err.
 func SkipFrames(err error, numFrames int) error {
@@ -286,15 +469,15 @@ func SkipFrames(err error, numFrames int) error {
 	return &oopsError{
 		inner:    e.inner,
 		previous: e.previous,
-		stack:    &stack{frames: frames},
+		stack:    &stack{frames: frames, header: st.header, time: st.time},
 		reason:   e.reason,
 		index:    e.index,
+		deferred: e.deferred,
 	}
 }
 
-// writeStackTrace unwinds a chain of oopsErrors and prints the stacktrace
-// annotated with explanatory messages.
-func (e *oopsError) writeStackTrace(b *strings.Builder) {
+// base returns the error whose message is printed at the top of e's stacktrace.
+func (e *oopsError) base() error {
 	var base error
 	var fallbackBase error
 	for err := error(e); err != nil; err = Unwrap(err) {
@@ -318,17 +501,38 @@ func (e *oopsError) writeStackTrace(b *strings.Builder) {
 		// be at the end of the chain (I'm paranoid).
 		base = fallbackBase
 	}
+	return base
+}
 
-	b.WriteString(base.Error())
-	b.WriteString("\n\n")
+// writeStackTrace unwinds a chain of oopsErrors and prints the stacktrace
+// annotated with explanatory messages.
+func (e *oopsError) writeStackTrace(b *strings.Builder) {
+	b.WriteString(e.base().Error())
 
-	frames, skipInfo := framesWithSkipInfo(e)
-	for i, stack := range frames {
-		// Include a newline between stacks.
-		if i > 0 {
+	if e.stack == nil {
+		// Lightweight errors have no frames, so only the reason chain is written.
+		if reason := e.Reason(); reason != "" {
+			b.WriteString("\n\n")
+			b.WriteString(reason)
 			b.WriteRune('\n')
 		}
-		writeSingleFrameTrace(b, stack, skipInfo[i])
+	} else {
+		b.WriteString("\n\n")
+
+		stacks := parseChainStacks(e)
+		for i, stack := range stacks {
+			// Include a newline between stacks.
+			if i > 0 {
+				b.WriteRune('\n')
+			}
+			writeStackHeader(b, stack.stack, stacks[0].stack)
+			writeSingleFrameTrace(b, stack.frames, stack.framesSkipped)
+		}
+	}
+
+	for _, deferred := range e.deferredErrors() {
+		b.WriteString("\ndeferred error: ")
+		deferred.writeStackTrace(b)
 	}
 }
 
@@ -346,6 +550,21 @@ func (e *oopsError) Reason() string {
 	return strings.Join(output, ": ")
 }
 
+// goroutineHeaderSize is the length of the start of the runtime.Stack header
+// kept for each stack, which fits "goroutine " and any goroutine ID.
+const goroutineHeaderSize = 32
+
+// goroutineID returns the ID of the goroutine st was captured on, parsed from
+// its header.
+func (st *stack) goroutineID() int64 {
+	b := bytes.TrimPrefix(st.header[:], []byte("goroutine "))
+	if i := bytes.IndexByte(b, ' '); i >= 0 {
+		b = b[:i]
+	}
+	id, _ := strconv.ParseInt(string(b), 10, 64)
+	return id
+}
+
 // isPrefix checks if a is a prefix of b.
 func isPrefix(a []uintptr, b []uintptr) bool {
 	if len(a) > len(b) {
@@ -379,7 +598,11 @@ func wrapf(err error, reason string) *oopsError {
 		if _, ok := err.(*oopsError); ok {
 			inner = e.inner
 		}
+	}
 
+	// A lightweight error has no stack to search, so it is upgraded by
+	// capturing a fresh stack below.
+	if e != nil && e.stack != nil {
 		// Figure out where we are in the existing callstack. Since Wrapf isn't
 		// guaranteed to be called at every stack frame, we need to search to find
 		// the current callsite. We start searching one level past the previous
@@ -418,7 +641,6 @@ func wrapf(err error, reason string) *oopsError {
 			}
 			index++
 		}
-
 	}
 
 	if !found {
@@ -430,7 +652,36 @@ func wrapf(err error, reason string) *oopsError {
 		copy(frames, buffer[:n])
 
 		index = 0
-		st = &stack{frames: frames}
+		st = &stack{frames: frames, time: time.Now()}
+		runtime.Stack(st.header[:], false)
+	}
+
+	return &oopsError{
+		inner:    inner,
+		previous: previous,
+		stack:    st,
+		reason:   reason,
+		index:    index,
+	}
+}
+
+// lightWrapf annotates err with a reason without capturing a stacktrace. If
+// err already carries a stacktrace, the reason is attached to the same frame as
+// err's outermost reason.
+func lightWrapf(err error, reason string) *oopsError {
+	inner := err
+	var previous *oopsError
+	var st *stack
+	var index int
+
+	var e *oopsError
+	if ok := As(err, &e); ok {
+		previous = e
+		if _, ok := err.(*oopsError); ok {
+			inner = e.inner
+		}
+		st = e.stack
+		index = e.index
 	}
 
 	return &oopsError{
@@ -449,7 +700,7 @@ func wrapf(err error, reason string) *oopsError {
 //
 // Note that the result of Errorf includes a stacktrace. This means
 // that Errorf is not suitable for storing in global variables. For
-// such errors, keep using errors.New.
+// such errors, use Lightf.
 func Errorf(format string, a ...interface{}) error {
 	return wrapf(fmt.Errorf(format, a...), "")
 }
@@ -485,6 +736,42 @@ func WrapfWithMetadata(err error, metadata map[string]interface{}, format string
 	return oopsErr
 }
 
+// Lightf creates a new lightweight error without a stacktrace.
+//
+// Use Lightf for sentinel and expected errors, such as validation failures or
+// not-found errors, which are stored in global variables or created often
+// enough that capturing a stacktrace is too expensive. Lightweight errors
+// participate in Reason and CollectMetadata like any other oops error. The
+// first time Wrapf is called on a lightweight error, it captures a stacktrace
+// and the error is rendered with frames from then on.
+func Lightf(format string, a ...interface{}) error {
+	return lightWrapf(fmt.Errorf(format, a...), "")
+}
+
+// LightWrapf annotates an error with a reason without capturing a stacktrace.
+// If err is nil, LightWrapf returns nil.
+//
+// If err already carries a stacktrace, the reason is attached to the frame of
+// err's outermost reason.
+func LightWrapf(err error, format string, a ...interface{}) error {
+	if err == nil {
+		return nil
+	}
+
+	return lightWrapf(err, fmt.Sprintf(format, a...))
+}
+
+// LightWrapfWithMetadata is like LightWrapf but also sets the metadata given in
+// the oops error. You can call CollectMetadata to retrieve the metadata later.
+func LightWrapfWithMetadata(err error, metadata map[string]interface{}, format string, a ...interface{}) error {
+	if err == nil {
+		return nil
+	}
+	oopsErr := lightWrapf(err, fmt.Sprintf(format, a...))
+	oopsErr.metadata = metadata
+	return oopsErr
+}
+
 // Deprecated: Use [errors.Is] or [errors.As] which are part of the standard library.
 //
 // Note that the behaviour of Cause differs from [errors.Is] and [errors.As]. Cause follows the error chain as long as the error is an oopsError. When a non oopsError is encountered, Cause returns the inner error of the oopsError. [errors.Is] and [errors.As] will follow the error chain until it finds an error that matches the target type.
@@ -500,6 +787,53 @@ func Cause(err error) error {
 	return err
 }
 
+// DeferClose closes closer and annotates the error it returns with a reason and
+// a stacktrace. Call DeferClose in a defer with a pointer to the function's named
+// error result:
+//
+//	func writeFile(name string) (err error) {
+//	  f, err := os.Create(name)
+//	  if err != nil {
+//	    return oops.Wrapf(err, "creating %s", name)
+//	  }
+//	  defer oops.DeferClose(&err, f, "closing %s", name)
+//	  ...
+//	}
+//
+// If the function is already returning an error, the close error does not
+// replace it. Both errors are retained: the result renders both stacktraces,
+// Frames returns the frames of both, and errors.Is and errors.As match either
+// of them, preferring the primary error.
+func DeferClose(errp *error, closer io.Closer, format string, a ...interface{}) {
+	// wrapf is called here rather than in a shared helper, because it captures
+	// the stack of the caller of the public function.
+	if err := closer.Close(); err != nil {
+		addDeferred(errp, wrapf(err, fmt.Sprintf(format, a...)))
+	}
+}
+
+// DeferFunc is like DeferClose, but calls f instead of closing an io.Closer. It
+// is useful for deferred calls such as flushing a writer or rolling back a
+// transaction.
+func DeferFunc(errp *error, f func() error, format string, a ...interface{}) {
+	if err := f(); err != nil {
+		addDeferred(errp, wrapf(err, fmt.Sprintf(format, a...)))
+	}
+}
+
+// addDeferred stores the error of a deferred call in *errp. If the function is
+// already returning an error, deferred is retained next to it instead of
+// replacing it.
+func addDeferred(errp *error, deferred *oopsError) {
+	if *errp == nil {
+		*errp = deferred
+		return
+	}
+	e := lightWrapf(*errp, "")
+	e.deferred = deferred
+	*errp = e
+}
+
 // Recover recovers from a panic in a defer. If there is no panic, Recover()
 // returns nil. To use, call oops.Recover(recover()) and compare the result to nil.
 func Recover(p interface{}) error {
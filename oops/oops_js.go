@@ -6,6 +6,7 @@ package oops
 import (
 	"errors"
 	"fmt"
+	"io"
 )
 
 // A Wrapper provides context around another error.
@@ -19,12 +20,22 @@ func Frames(err error) [][]Frame {
 	return nil
 }
 
+func Stacks(err error) []Stack {
+	return nil
+}
+
 var Errorf = fmt.Errorf
 
 func Wrapf(err error, format string, a ...interface{}) error {
 	return err
 }
 
+var Lightf = fmt.Errorf
+
+func LightWrapf(err error, format string, a ...interface{}) error {
+	return err
+}
+
 func Cause(err error) error {
 	return err
 }
@@ -37,6 +48,18 @@ func Recover(p interface{}) error {
 	return errors.New("recovered panic")
 }
 
+func DeferClose(errp *error, closer io.Closer, format string, a ...interface{}) {
+	if err := closer.Close(); err != nil && *errp == nil {
+		*errp = err
+	}
+}
+
+func DeferFunc(errp *error, f func() error, format string, a ...interface{}) {
+	if err := f(); err != nil && *errp == nil {
+		*errp = err
+	}
+}
+
 func Unwrap(err error) error {
 	return err
 }
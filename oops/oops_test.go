@@ -90,6 +90,17 @@ func fixLineNumbers(s string) string {
 	return re.ReplaceAllString(s, `.$1:123`)
 }
 
+func fixStackHeaders(s string) string {
+	// Standardize the goroutine IDs, capture times and elapsed durations in stack headers, which vary between runs.
+	re := regexp.MustCompile(`(?m)^goroutine \d+ at \S+( \(\+\S+\))?$`)
+	return re.ReplaceAllStringFunc(s, func(header string) string {
+		if strings.HasSuffix(header, ")") {
+			return "goroutine N at TIME (+DELTA)"
+		}
+		return "goroutine N at TIME"
+	})
+}
+
 var rootCause = errors.New("some root cause")
 
 func runWithRecover(f func()) (err error) {
@@ -178,6 +189,7 @@ func TestErrors(t *testing.T) {
 			Cause: io.EOF,
 			Verbose: `EOF
 
+goroutine N at TIME
 github.com/samsarahq/go/oops_test.z: reading failed
 	github.com/samsarahq/go/oops/oops_test.go:123
 github.com/samsarahq/go/oops_test.y: i guess some IO went wrong
@@ -195,6 +207,7 @@ testing.tRunner
 			Cause: rootCause,
 			Verbose: `some root cause
 
+goroutine N at TIME
 github.com/samsarahq/go/oops_test.rc: something rooty
 	github.com/samsarahq/go/oops/oops_test.go:123
 github.com/samsarahq/go/oops_test.TestErrors
@@ -210,6 +223,7 @@ testing.tRunner
 			Cause: rootCause,
 			Verbose: `some root cause
 
+goroutine N at TIME
 github.com/samsarahq/go/oops_test.doubleWrapf: yuck
 	github.com/samsarahq/go/oops/oops_test.go:123
 github.com/samsarahq/go/oops_test.TestErrors
@@ -217,6 +231,7 @@ github.com/samsarahq/go/oops_test.TestErrors
 testing.tRunner
 	testing/testing.go:123
 
+goroutine N at TIME (+DELTA)
 github.com/samsarahq/go/oops_test.doubleWrapf: bad
 	github.com/samsarahq/go/oops/oops_test.go:123
 github.com/samsarahq/go/oops_test.TestErrors
@@ -224,6 +239,7 @@ github.com/samsarahq/go/oops_test.TestErrors
 testing.tRunner
 	testing/testing.go:123
 
+goroutine N at TIME (+DELTA)
 github.com/samsarahq/go/oops_test.doubleWrapf: why would you do this
 	github.com/samsarahq/go/oops/oops_test.go:123
 github.com/samsarahq/go/oops_test.TestErrors
@@ -238,6 +254,7 @@ testing.tRunner
 			Short: "problem in c: 10",
 			Verbose: `problem in c: 10
 
+goroutine N at TIME
 github.com/samsarahq/go/oops_test.c
 	github.com/samsarahq/go/oops/oops_test.go:123
 github.com/samsarahq/go/oops_test.b: b failed too
@@ -256,6 +273,7 @@ testing.tRunner
 			Short: "problem in c: 10",
 			Verbose: `problem in c: 10
 
+goroutine N at TIME
 github.com/samsarahq/go/oops_test.c
 	github.com/samsarahq/go/oops/oops_test.go:123
 github.com/samsarahq/go/oops_test.b: b failed too
@@ -265,6 +283,7 @@ github.com/samsarahq/go/oops_test.a: no no no
 github.com/samsarahq/go/oops_test.bb.func1: causing trouble
 	github.com/samsarahq/go/oops/oops_test.go:123
 
+goroutine N at TIME (+DELTA)
 github.com/samsarahq/go/oops_test.bb: bb had a bad time
 	github.com/samsarahq/go/oops/oops_test.go:123
 github.com/samsarahq/go/oops_test.aa: aa didn't quite work out
@@ -281,6 +300,7 @@ testing.tRunner
 			Short: "problem in c: 10",
 			Verbose: `problem in c: 10
 
+goroutine N at TIME
 github.com/samsarahq/go/oops_test.c
 	github.com/samsarahq/go/oops/oops_test.go:123
 github.com/samsarahq/go/oops_test.b: b failed too
@@ -311,6 +331,7 @@ testing.tRunner
 			Short: "problem in c: 10",
 			Verbose: `problem in c: 10
 
+goroutine N at TIME
 github.com/samsarahq/go/oops_test.c
 	github.com/samsarahq/go/oops/oops_test.go:123
 github.com/samsarahq/go/oops_test.b: b failed too
@@ -344,6 +365,7 @@ testing.tRunner
 			Short: "runtime error: invalid memory address or nil pointer dereference",
 			Verbose: `runtime error: invalid memory address or nil pointer dereference
 
+goroutine N at TIME
 github.com/samsarahq/go/oops_test.runWithRecover.func1: recovered panic
 	github.com/samsarahq/go/oops/oops_test.go:123
 runtime.gopanic
@@ -372,6 +394,7 @@ testing.tRunner
 			Short: "recovered panic: bad",
 			Verbose: `recovered panic: bad
 
+goroutine N at TIME
 github.com/samsarahq/go/oops_test.runWithRecover.func1
 	github.com/samsarahq/go/oops/oops_test.go:123
 runtime.gopanic
@@ -394,6 +417,7 @@ testing.tRunner
 			Short: "uh oh",
 			Verbose: `uh oh
 
+goroutine N at TIME
 github.com/samsarahq/go/oops_test.runWithRecover.func1: recovered panic
 	github.com/samsarahq/go/oops/oops_test.go:123
 runtime.gopanic
@@ -416,6 +440,7 @@ testing.tRunner
 			Short: "help!",
 			Verbose: `help!
 
+goroutine N at TIME
 github.com/samsarahq/go/oops_test.TestErrors.func4
 	github.com/samsarahq/go/oops/oops_test.go:123
 github.com/samsarahq/go/oops_test.runWithRecover
@@ -425,6 +450,7 @@ github.com/samsarahq/go/oops_test.TestErrors
 testing.tRunner
 	testing/testing.go:123
 
+goroutine N at TIME (+DELTA)
 github.com/samsarahq/go/oops_test.runWithRecover.func1: recovered panic
 	github.com/samsarahq/go/oops/oops_test.go:123
 runtime.gopanic
@@ -445,6 +471,7 @@ testing.tRunner
 			Short: "wrapper",
 			Verbose: `base
 
+goroutine N at TIME
 github.com/samsarahq/go/oops_test.oopsChain: a
 	github.com/samsarahq/go/oops/oops_test.go:123
 github.com/samsarahq/go/oops_test.TestErrors
@@ -452,6 +479,7 @@ github.com/samsarahq/go/oops_test.TestErrors
 testing.tRunner
 	testing/testing.go:123
 
+goroutine N at TIME (+DELTA)
 github.com/samsarahq/go/oops_test.oopsChain: b
 	github.com/samsarahq/go/oops/oops_test.go:123
 github.com/samsarahq/go/oops_test.TestErrors
@@ -459,6 +487,7 @@ github.com/samsarahq/go/oops_test.TestErrors
 testing.tRunner
 	testing/testing.go:123
 
+goroutine N at TIME (+DELTA)
 github.com/samsarahq/go/oops_test.oopsChain: c
 	github.com/samsarahq/go/oops/oops_test.go:123
 github.com/samsarahq/go/oops_test.TestErrors
@@ -466,6 +495,7 @@ github.com/samsarahq/go/oops_test.TestErrors
 testing.tRunner
 	testing/testing.go:123
 
+goroutine N at TIME (+DELTA)
 github.com/samsarahq/go/oops_test.oopsChain: d
 	github.com/samsarahq/go/oops/oops_test.go:123
 github.com/samsarahq/go/oops_test.TestErrors
@@ -480,6 +510,7 @@ testing.tRunner
 			Short: "somePrefix: test error",
 			Verbose: `somePrefix: test error
 
+goroutine N at TIME
 github.com/samsarahq/go/oops_test.TestErrors: oops err
 	github.com/samsarahq/go/oops/oops_test.go:123
 testing.tRunner
@@ -490,7 +521,7 @@ testing.tRunner
 
 	for _, testcase := range testcases {
 		t.Run(testcase.Title, func(t *testing.T) {
-			actualVerbose := fixLineNumbers(fmt.Sprint(testcase.Error))
+			actualVerbose := fixStackHeaders(fixLineNumbers(fmt.Sprint(testcase.Error)))
 			actualVerbose, err := stripPathPrefix(actualVerbose)
 			assert.NoError(t, err)
 			if actualVerbose != testcase.Verbose {
@@ -581,6 +612,49 @@ func TestFrames(t *testing.T) {
 	}
 }
 
+func TestStacks(t *testing.T) {
+	assert.Nil(t, oops.Stacks(errors.New("not oops")))
+
+	err := aa()
+	stacks := oops.Stacks(err)
+	if !assert.Len(t, stacks, 2) {
+		t.FailNow()
+	}
+	assert.Equal(t, oops.Frames(err), [][]oops.Frame{stacks[0].Frames, stacks[1].Frames})
+	// The first stack was captured in a goroutine started by bb.
+	assert.NotEqual(t, stacks[0].GoroutineID, stacks[1].GoroutineID)
+	assert.NotZero(t, stacks[0].GoroutineID)
+	assert.NotZero(t, stacks[1].GoroutineID)
+	assert.False(t, stacks[1].Time.Before(stacks[0].Time))
+
+	for _, stack := range stacks {
+		assert.False(t, stack.Truncated)
+		assert.Equal(t, "problem in c: 10", stack.Base.Error())
+		assert.Len(t, stack.Reasons, len(stack.PCs))
+		assert.GreaterOrEqual(t, len(stack.PCs), len(stack.Frames))
+		if !assert.NotEmpty(t, stack.Frames) {
+			t.FailNow()
+		}
+		frame, _ := runtime.CallersFrames(stack.PCs).Next()
+		assert.Equal(t, stack.Frames[0].Function, frame.Function)
+	}
+	if !assert.GreaterOrEqual(t, len(stacks[0].Reasons), 4) {
+		t.FailNow()
+	}
+	assert.Equal(t, []string{"", "b failed too", "no no no", "causing trouble"}, stacks[0].Reasons[:4])
+}
+
+func TestStacksTruncated(t *testing.T) {
+	defer oops.SetPrefixesToShortCircuit()
+	oops.SetPrefixesToShortCircuit(getFileDirectory(t, 0))
+
+	stacks := oops.Stacks(oops.Errorf("truncated"))
+	assert.Len(t, stacks, 1)
+	assert.True(t, stacks[0].Truncated)
+	assert.Empty(t, stacks[0].Frames)
+	assert.NotEmpty(t, stacks[0].PCs)
+}
+
 func TestCause(t *testing.T) {
 	base := &baseErr{}
 	a := oops.Wrapf(base, "a")
@@ -688,6 +762,134 @@ func TestStackedOopsErrors(t *testing.T) {
 	assert.Equal(t, "a: b: c: d", e.Reason())
 }
 
+var errLightNotFound = oops.Lightf("not found")
+
+func lightLookup() error {
+	return oops.LightWrapfWithMetadata(errLightNotFound, map[string]interface{}{"id": 5}, "looking up 5")
+}
+
+func lightHandler() error {
+	return oops.Wrapf(lightLookup(), "handling request")
+}
+
+func TestLightweight(t *testing.T) {
+	err := lightLookup()
+	assert.Equal(t, "not found\n\nlooking up 5\n", err.Error())
+	assert.Equal(t, "looking up 5", err.(reasonErr).Reason())
+	assert.Equal(t, map[string]interface{}{"id": 5}, oops.CollectMetadata(err))
+	assert.Nil(t, oops.Frames(err))
+	assert.Nil(t, oops.Stacks(err))
+	assert.Equal(t, "", oops.MainStackToString(err))
+	assert.True(t, errors.Is(err, errLightNotFound))
+
+	assert.Equal(t, "not found", errLightNotFound.Error())
+	assert.Nil(t, oops.LightWrapf(nil, "nothing"))
+}
+
+func TestLightweightUpgrade(t *testing.T) {
+	err := lightHandler()
+	assert.Equal(t, "handling request: looking up 5", err.(reasonErr).Reason())
+	assert.Equal(t, map[string]interface{}{"id": 5}, oops.CollectMetadata(err))
+	assert.True(t, errors.Is(err, errLightNotFound))
+
+	verbose, pathErr := stripPathPrefix(fixStackHeaders(fixLineNumbers(err.Error())))
+	assert.NoError(t, pathErr)
+	assert.Equal(t, `not found
+
+goroutine N at TIME
+github.com/samsarahq/go/oops_test.lightHandler: handling request: looking up 5
+	github.com/samsarahq/go/oops/oops_test.go:123
+github.com/samsarahq/go/oops_test.TestLightweightUpgrade
+	github.com/samsarahq/go/oops/oops_test.go:123
+testing.tRunner
+	testing/testing.go:123
+`, verbose)
+
+	// Wrapping again reuses the stack captured during the upgrade.
+	assert.Len(t, oops.Frames(oops.Wrapf(err, "again")), 1)
+}
+
+func TestLightWrapfOnStackedError(t *testing.T) {
+	err := oops.LightWrapf(oops.Errorf("boom"), "cheap context")
+	frames := oops.Frames(err)
+	assert.Len(t, frames, 1)
+	assert.Equal(t, "cheap context", frames[0][0].Reason)
+	assert.Equal(t, "cheap context", err.(reasonErr).Reason())
+}
+
+type closer struct {
+	err error
+}
+
+func (c closer) Close() error {
+	return c.err
+}
+
+var errClose = errors.New("close failed")
+
+func deferClose(primary error, closeErr error) (err error) {
+	defer oops.DeferClose(&err, closer{err: closeErr}, "closing %s", "file")
+	return primary
+}
+
+func TestDeferClose(t *testing.T) {
+	assert.NoError(t, deferClose(nil, nil))
+	assert.Equal(t, rootCause, deferClose(rootCause, nil))
+
+	err := deferClose(nil, errClose)
+	assert.True(t, errors.Is(err, errClose))
+	assert.Equal(t, "closing file", err.(reasonErr).Reason())
+	assert.Len(t, oops.Frames(err), 1)
+}
+
+func TestDeferCloseWithPrimaryError(t *testing.T) {
+	err := deferClose(rc(), &baseErr{})
+	assert.True(t, errors.Is(err, rootCause))
+	var target *baseErr
+	assert.True(t, errors.As(err, &target))
+	assert.Equal(t, rootCause, oops.Cause(err))
+
+	frames := oops.Frames(err)
+	assert.Len(t, frames, 2)
+	assert.Equal(t, "something rooty", frames[0][0].Reason)
+	assert.Equal(t, "closing file", frames[1][0].Reason)
+
+	verbose, pathErr := stripPathPrefix(fixStackHeaders(fixLineNumbers(err.Error())))
+	assert.NoError(t, pathErr)
+	assert.Equal(t, `some root cause
+
+goroutine N at TIME
+github.com/samsarahq/go/oops_test.rc: something rooty
+	github.com/samsarahq/go/oops/oops_test.go:123
+github.com/samsarahq/go/oops_test.TestDeferCloseWithPrimaryError
+	github.com/samsarahq/go/oops/oops_test.go:123
+testing.tRunner
+	testing/testing.go:123
+
+deferred error: base
+
+goroutine N at TIME
+github.com/samsarahq/go/oops_test.deferClose: closing file
+	github.com/samsarahq/go/oops/oops_test.go:123
+github.com/samsarahq/go/oops_test.TestDeferCloseWithPrimaryError
+	github.com/samsarahq/go/oops/oops_test.go:123
+testing.tRunner
+	testing/testing.go:123
+`, verbose)
+}
+
+func TestDeferFunc(t *testing.T) {
+	f := func() (err error) {
+		defer oops.DeferFunc(&err, func() error { return errClose }, "flushing")
+		defer oops.DeferFunc(&err, func() error { return rootCause }, "rolling back")
+		return nil
+	}
+	err := f()
+	assert.True(t, errors.Is(err, rootCause))
+	assert.True(t, errors.Is(err, errClose))
+	assert.Len(t, oops.Frames(err), 2)
+}
+
 func TestPrintMainStack(t *testing.T) {
 	tests := []struct {
 		name string
@@ -699,6 +901,7 @@ func TestPrintMainStack(t *testing.T) {
 			err:  oops.Errorf("test"),
 			want: `test
 
+goroutine N at TIME
 github.com/samsarahq/go/oops_test.TestPrintMainStack
 	github.com/samsarahq/go/oops/oops_test.go:XXX
 testing.tRunner
@@ -710,6 +913,7 @@ testing.tRunner
 			err:  chain(),
 			want: `base
 
+goroutine N at TIME
 github.com/samsarahq/go/oops_test.chain: a
 	github.com/samsarahq/go/oops/oops_test.go:XXX
 github.com/samsarahq/go/oops_test.TestPrintMainStack
@@ -734,7 +938,7 @@ testing.tRunner
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := oops.MainStackToString(tt.err)
+			got := fixStackHeaders(oops.MainStackToString(tt.err))
 			got = digitRegex.ReplaceAllString(got, "XXX")
 			got, err := stripPathPrefix(got)
 			assert.NoError(t, err)
@@ -847,6 +1051,7 @@ func TestErrorStringTruncation(t *testing.T) {
 			prefixesToShortCircuit: []string{},
 			expectedOutput: `not great, bob
 
+goroutine N at TIME
 github.com/samsarahq/go/oops_test.TestErrorStringTruncation
 	oops/oops_test.go:123
 testing.tRunner
@@ -859,6 +1064,7 @@ testing.tRunner
 			prefixesToShortCircuit: []string{goTestDir},
 			expectedOutput: `not great, bob
 
+goroutine N at TIME
 github.com/samsarahq/go/oops_test.TestErrorStringTruncation
 	oops/oops_test.go:123
 subsequent stack frames truncated
@@ -870,6 +1076,7 @@ subsequent stack frames truncated
 			prefixesToShortCircuit: []string{oopsTestDir},
 			expectedOutput: `not great, bob
 
+goroutine N at TIME
 subsequent stack frames truncated
 
 `,
@@ -879,6 +1086,7 @@ subsequent stack frames truncated
 			prefixesToShortCircuit: []string{oopsTestDir, goTestDir},
 			expectedOutput: `not great, bob
 
+goroutine N at TIME
 subsequent stack frames truncated
 
 `,
@@ -892,7 +1100,7 @@ subsequent stack frames truncated
 			// Remove the content before 'oops/' and 'testing/' in lines that contain said strings so that the tests
 			// for oops are portable.
 			sanitizedErrText := stripPrecedingFromAllLines(errText, "oops/", "testing/")
-			sanitizedErrText = fixLineNumbers(sanitizedErrText)
+			sanitizedErrText = fixStackHeaders(fixLineNumbers(sanitizedErrText))
 			assert.Equal(t, tc.expectedOutput, sanitizedErrText)
 		})
 	}
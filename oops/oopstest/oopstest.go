@@ -0,0 +1,125 @@
+//go:build !js
+// +build !js
+
+// Package oopstest provides assertions for testing code that returns oops
+// errors.
+//
+// Stack traces contain absolute file paths and line numbers, which makes them
+// hard to compare in tests. Normalize rewrites an error's output so it can be
+// compared against golden files or snapshots.
+package oopstest
+
+import (
+	"errors"
+	"path"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/samsarahq/go/oops"
+)
+
+// T is the subset of *testing.T used by the assertions in this package.
+type T interface {
+	Errorf(format string, args ...interface{})
+	Helper()
+}
+
+// reasoner is implemented by oops errors.
+type reasoner interface {
+	Reason() string
+}
+
+// Reason returns the reason chain of the first oops error in err's chain, or
+// an empty string if there is none.
+func Reason(err error) string {
+	var r reasoner
+	if !errors.As(err, &r) {
+		return ""
+	}
+	return r.Reason()
+}
+
+// HasReasonChain asserts that err is an oops error whose reason chain, as
+// returned by Reason, equals reasons joined with ": ".
+func HasReasonChain(t T, err error, reasons ...string) bool {
+	t.Helper()
+	var r reasoner
+	if !errors.As(err, &r) {
+		t.Errorf("expected an oops error, got %v", err)
+		return false
+	}
+	expected := strings.Join(reasons, ": ")
+	if actual := r.Reason(); actual != expected {
+		t.Errorf("reason chain differs:\nexpected: %q\nactual:   %q", expected, actual)
+		return false
+	}
+	return true
+}
+
+// CreatedIn asserts that the first stack trace of err starts in function
+// function. function can be a fully qualified function name or have its
+// import path omitted, such as "oopstest.TestCreatedIn".
+func CreatedIn(t T, err error, function string) bool {
+	t.Helper()
+	frames := oops.Frames(err)
+	if len(frames) == 0 || len(frames[0]) == 0 {
+		t.Errorf("expected an oops error with a stack trace, got %v", err)
+		return false
+	}
+	actual := frames[0][0].Function
+	if actual != function && !strings.HasSuffix(actual, "/"+function) {
+		t.Errorf("expected error to be created in %s, but was created in %s", function, actual)
+		return false
+	}
+	return true
+}
+
+// HasMetadata asserts that the metadata collected from err with
+// oops.CollectMetadata contains key with the given value.
+func HasMetadata(t T, err error, key string, value interface{}) bool {
+	t.Helper()
+	metadata := oops.CollectMetadata(err)
+	actual, ok := metadata[key]
+	if !ok {
+		t.Errorf("expected metadata to contain %q, got %v", key, metadata)
+		return false
+	}
+	if !reflect.DeepEqual(actual, value) {
+		t.Errorf("metadata %q differs:\nexpected: %#v\nactual:   %#v", key, value, actual)
+		return false
+	}
+	return true
+}
+
+// fileLineRegex matches the file and line of a frame in an oops stack trace.
+var fileLineRegex = regexp.MustCompile(`^\t(.*):\d+$`)
+
+// stackHeaderRegex matches the header with the goroutine and capture time of a
+// stack in an oops stack trace.
+var stackHeaderRegex = regexp.MustCompile(`^goroutine \d+ at \S+( \(\+\S+\))?$`)
+
+// Normalize returns the output of err.Error() with every frame's file replaced
+// by its last directory and file name, every line number replaced by "N", and
+// every stack header replaced by "goroutine N". The result does not depend on
+// where the source is checked out, on line numbers or on timing, so it is
+// suitable for golden and snapshot comparisons.
+func Normalize(err error) string {
+	if err == nil {
+		return ""
+	}
+	lines := strings.Split(err.Error(), "\n")
+	for i, line := range lines {
+		if stackHeaderRegex.MatchString(line) {
+			lines[i] = "goroutine N"
+			continue
+		}
+		match := fileLineRegex.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		file := match[1]
+		lines[i] = "\t" + path.Join(path.Base(path.Dir(file)), path.Base(file)) + ":N"
+	}
+	return strings.Join(lines, "\n")
+}
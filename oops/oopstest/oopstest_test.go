@@ -0,0 +1,80 @@
+package oopstest_test
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/samsarahq/go/oops"
+	"github.com/samsarahq/go/oops/oopstest"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockT struct {
+	errors []string
+}
+
+func (m *mockT) Helper() {
+}
+
+func (m *mockT) Errorf(format string, args ...interface{}) {
+	m.errors = append(m.errors, fmt.Sprintf(format, args...))
+}
+
+func read() error {
+	return oops.Wrapf(io.EOF, "reading")
+}
+
+func load() error {
+	return oops.WrapfWithMetadata(read(), map[string]interface{}{"file": "a.txt"}, "loading %s", "a.txt")
+}
+
+func TestHasReasonChain(t *testing.T) {
+	err := load()
+	assert.True(t, oopstest.HasReasonChain(t, err, "loading a.txt", "reading"))
+	assert.Equal(t, "loading a.txt: reading", oopstest.Reason(err))
+
+	var m mockT
+	assert.False(t, oopstest.HasReasonChain(&m, err, "reading"))
+	assert.False(t, oopstest.HasReasonChain(&m, io.EOF, "reading"))
+	assert.Len(t, m.errors, 2)
+}
+
+func TestCreatedIn(t *testing.T) {
+	err := load()
+	assert.True(t, oopstest.CreatedIn(t, err, "github.com/samsarahq/go/oops/oopstest_test.read"))
+	assert.True(t, oopstest.CreatedIn(t, err, "oopstest_test.read"))
+
+	var m mockT
+	assert.False(t, oopstest.CreatedIn(&m, err, "oopstest_test.load"))
+	assert.False(t, oopstest.CreatedIn(&m, errors.New("plain"), "oopstest_test.load"))
+	assert.Len(t, m.errors, 2)
+}
+
+func TestHasMetadata(t *testing.T) {
+	err := load()
+	assert.True(t, oopstest.HasMetadata(t, err, "file", "a.txt"))
+
+	var m mockT
+	assert.False(t, oopstest.HasMetadata(&m, err, "file", "b.txt"))
+	assert.False(t, oopstest.HasMetadata(&m, err, "missing", "a.txt"))
+	assert.Len(t, m.errors, 2)
+}
+
+func TestNormalize(t *testing.T) {
+	expected := `EOF
+
+goroutine N
+github.com/samsarahq/go/oops/oopstest_test.read: reading
+	oopstest/oopstest_test.go:N
+github.com/samsarahq/go/oops/oopstest_test.load: loading a.txt
+	oopstest/oopstest_test.go:N
+github.com/samsarahq/go/oops/oopstest_test.TestNormalize
+	oopstest/oopstest_test.go:N
+testing.tRunner
+	testing/testing.go:N
+`
+	assert.Equal(t, expected, oopstest.Normalize(load()))
+	assert.Equal(t, "", oopstest.Normalize(nil))
+}
@@ -1,5 +1,7 @@
 package oops
 
+import "time"
+
 // This file is for exported types
 
 // Frame represents a Frame in an oops callstack.
@@ -10,3 +12,26 @@ type Frame struct {
 	// Reason is the manual annotation passed to oops.Wrapf.
 	Reason string
 }
+
+// Stack represents a stack captured by an oops error, starting with the frame
+// closest to where it was captured.
+type Stack struct {
+	Frames []Frame
+	// Truncated is whether frames were left out of Frames because their file
+	// matched a prefix passed to SetPrefixesToShortCircuit.
+	Truncated bool
+	// Base is the base error of the chain of oops errors the stack belongs to.
+	// It is the message printed at the top of the error's stacktrace.
+	Base error
+	// Reasons holds the reason added at each program counter in PCs, or an
+	// empty string if no reason was added there.
+	Reasons []string
+	// PCs are the program counters of the stack, as returned by
+	// runtime.Callers. Unlike Frames, PCs are never truncated.
+	PCs []uintptr
+	// GoroutineID is the ID of the goroutine the stack was captured on.
+	GoroutineID int64
+	// Time is when the stack was captured. It includes a monotonic clock
+	// reading, so durations between stacks can be computed with Time.Sub.
+	Time time.Time
+}
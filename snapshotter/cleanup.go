@@ -0,0 +1,98 @@
+package snapshotter
+
+import (
+	"sort"
+	"strings"
+)
+
+// CleanupT is a T that can register functions to call when the test and all
+// of its subtests finish, such as *testing.T.
+type CleanupT interface {
+	T
+	Cleanup(f func())
+}
+
+// NewWithCleanup creates a new Snapshotter that is verified when the test
+// finishes, so there is no need to call Verify:
+//
+//	ss := snapshotter.NewWithCleanup(t)
+//	ss.Snapshot("complicated", output)
+//
+// Subtests, including parallel ones, can take snapshots with Child. If the
+// test calls Verify or VerifyWithImage itself, the snapshots are not verified
+// again when the test finishes, unless more snapshots were taken since.
+func NewWithCleanup(t CleanupT) *Snapshotter {
+	s := New(t)
+	t.Cleanup(func() {
+		t.Helper()
+		s.mu.Lock()
+		verified := s.verified
+		s.mu.Unlock()
+		if !verified {
+			s.Verify()
+		}
+	})
+	return s
+}
+
+// Child returns a Snapshotter for the subtest t of the test of s. Snapshots
+// taken by the child are stored in the snapshot file of s, with names prefixed
+// by the name of the subtest relative to the test of s, such as "case 1/value".
+// Children are verified by their parent, so they should not be verified
+// themselves, and the parent must be verified after all subtests finish, as
+// NewWithCleanup does.
+//
+// Snapshots of children are stored after the snapshots of their parent, and
+// ordered by subtest name, so that parallel subtests don't change the order
+// of the snapshots.
+func (s *Snapshotter) Child(t T) *Snapshotter {
+	t.Helper()
+	root := s.root()
+	prefix := root.t.Name() + "/"
+	if !strings.HasPrefix(t.Name(), prefix) {
+		t.Errorf("%s is not a subtest of %s", t.Name(), root.t.Name())
+	}
+	return &Snapshotter{t: t, parent: root, prefix: strings.TrimPrefix(t.Name(), prefix) + "/"}
+}
+
+// root returns the Snapshotter storing the snapshots of s.
+func (s *Snapshotter) root() *Snapshotter {
+	if s.parent != nil {
+		return s.parent
+	}
+	return s
+}
+
+// sortChildSnapshots orders the snapshots of children after the snapshots of
+// s, by subtest name. s.mu must be held.
+func (s *Snapshotter) sortChildSnapshots() {
+	sort.SliceStable(s.snapshots, func(i, j int) bool {
+		return s.snapshots[i].prefix < s.snapshots[j].prefix
+	})
+}
+
+// checkVerified reports snapshots that were taken but never verified when the
+// test finishes, if t supports it, and releases the snapshot file so that it
+// can be used by other tests. The snapshot files of skipped tests are recorded
+// as used, so that Main doesn't delete them.
+func (s *Snapshotter) checkVerified() {
+	t, ok := s.t.(CleanupT)
+	if !ok {
+		return
+	}
+	t.Cleanup(func() {
+		t.Helper()
+		skipped := false
+		if skipper, ok := t.(interface{ Skipped() bool }); ok && skipper.Skipped() {
+			skipped = true
+			usedFiles.skip(s.snapshotRoot(), s.SnapshotFileName())
+		}
+		s.mu.Lock()
+		unverified := len(s.snapshots) > 0 && !s.verified
+		s.release()
+		s.mu.Unlock()
+		if unverified && !skipped {
+			t.Errorf("snapshots in %s were taken but never verified. Call Verify, or create the Snapshotter with NewWithCleanup.", s.SnapshotFileName())
+		}
+	})
+}
@@ -0,0 +1,249 @@
+// Command snapshotter reviews the pending snapshots written by snapshot tests
+// whose snapshots differ from their snapshot files, and lints snapshot files.
+//
+// Usage:
+//
+//	snapshotter list [-snapshots] [dir ...]
+//	snapshotter diff [file or dir ...]
+//	snapshotter accept [-all] [-snapshot name ...] [file ...]
+//	snapshotter reject [-all] [-snapshot name ...] [file ...]
+//	snapshotter lint [-w] [-maxSize bytes] [file or dir ...]
+//
+// list prints the snapshot files with pending changes in the directories, and
+// with -snapshots the names of their differing snapshots. diff prints their
+// changes. Directories default to the current directory. accept replaces
+// snapshot files with their pending snapshots, and reject removes the pending
+// snapshots. Both act on the given snapshot files, or on all pending changes
+// in the current directory with -all. With -snapshot, which may be repeated,
+// they act only on the snapshots with the names in a single snapshot file,
+// and keep its other snapshots pending.
+//
+// lint checks snapshot files without running tests, and exits with a non-zero
+// status if it finds problems, so it can run as a pre-commit hook. With -w it
+// formats snapshot files canonically instead of reporting them.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/samsarahq/go/snapshotter"
+)
+
+// commands are the subcommands of snapshotter by name.
+var commands = map[string]func(args []string) error{
+	"list":   list,
+	"diff":   diff,
+	"accept": accept,
+	"reject": reject,
+	"lint":   lint,
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage: snapshotter <command> [arguments]
+
+commands:
+  list [-snapshots] [dir ...]
+                            list snapshot files with pending changes
+  diff [file or dir ...]    show pending changes
+  accept [-all] [-snapshot name ...] [file ...]
+                            accept pending changes
+  reject [-all] [-snapshot name ...] [file ...]
+                            reject pending changes
+  lint [-w] [-maxSize bytes] [file or dir ...]
+                            check and format snapshot files
+`)
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	command, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+	}
+	if err := command(os.Args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "snapshotter %s: %s\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+// findChanges returns the pending changes of the snapshot files in args, and
+// in the directories in args. Without args it returns the pending changes in
+// the current directory.
+func findChanges(args []string) ([]*snapshotter.PendingChange, error) {
+	if len(args) == 0 {
+		args = []string{"."}
+	}
+	var changes []*snapshotter.PendingChange
+	for _, arg := range args {
+		if info, err := os.Stat(arg); err == nil && info.IsDir() {
+			found, err := snapshotter.FindPendingChanges(arg)
+			if err != nil {
+				return nil, err
+			}
+			changes = append(changes, found...)
+			continue
+		}
+		change, err := snapshotter.PendingChangeOf(arg)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+func list(args []string) error {
+	flags := flag.NewFlagSet("list", flag.ExitOnError)
+	snapshots := flags.Bool("snapshots", false, "list the names of the differing snapshots of each snapshot file")
+	flags.Parse(args)
+
+	changes, err := findChanges(flags.Args())
+	if err != nil {
+		return err
+	}
+	for _, change := range changes {
+		fmt.Println(change.SnapshotFile)
+		if !*snapshots {
+			continue
+		}
+		names, err := change.Snapshots()
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			fmt.Printf("\t%s\n", name)
+		}
+	}
+	return nil
+}
+
+func diff(args []string) error {
+	changes, err := findChanges(args)
+	if err != nil {
+		return err
+	}
+	for _, change := range changes {
+		text, err := change.Diff()
+		if err != nil {
+			return err
+		}
+		fmt.Print(text)
+	}
+	return nil
+}
+
+func accept(args []string) error {
+	return resolve("accept", args, (*snapshotter.PendingChange).Accept, (*snapshotter.PendingChange).AcceptSnapshots, "accepted")
+}
+
+func reject(args []string) error {
+	return resolve("reject", args, (*snapshotter.PendingChange).Reject, (*snapshotter.PendingChange).RejectSnapshots, "rejected")
+}
+
+// names is a flag that may be repeated.
+type names []string
+
+func (n *names) String() string {
+	return strings.Join(*n, ", ")
+}
+
+func (n *names) Set(name string) error {
+	*n = append(*n, name)
+	return nil
+}
+
+// resolve accepts or rejects the pending changes of the snapshot files in
+// args, or all pending changes with -all, or only the snapshots given with
+// -snapshot.
+func resolve(name string, args []string, action func(*snapshotter.PendingChange) error, snapshotsAction func(*snapshotter.PendingChange, ...string) error, done string) error {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	all := flags.Bool("all", false, "resolve all pending changes in the current directory")
+	var snapshots names
+	flags.Var(&snapshots, "snapshot", "resolve only the snapshot with this name, and keep the others pending")
+	flags.Parse(args)
+
+	switch {
+	case *all && flags.NArg() > 0:
+		return fmt.Errorf("-all cannot be combined with snapshot files")
+	case !*all && flags.NArg() == 0:
+		return fmt.Errorf("no snapshot files given. Use -all to %s all pending changes", name)
+	case len(snapshots) > 0 && (*all || flags.NArg() != 1):
+		return fmt.Errorf("-snapshot requires exactly one snapshot file")
+	}
+	var changes []*snapshotter.PendingChange
+	var err error
+	if *all {
+		changes, err = snapshotter.FindPendingChanges(".")
+	} else {
+		changes, err = findChanges(flags.Args())
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, change := range changes {
+		if len(snapshots) > 0 {
+			if err := snapshotsAction(change, snapshots...); err != nil {
+				return err
+			}
+			fmt.Printf("%s %s in %s\n", done, snapshots.String(), change.SnapshotFile)
+			continue
+		}
+		if err := action(change); err != nil {
+			return err
+		}
+		fmt.Printf("%s %s\n", done, change.SnapshotFile)
+	}
+	return nil
+}
+
+// errProblems is returned by lint when it found problems, which it already
+// printed.
+var errProblems = errors.New("found problems in snapshot files")
+
+func lint(args []string) error {
+	flags := flag.NewFlagSet("lint", flag.ExitOnError)
+	fix := flags.Bool("w", false, "format snapshot files canonically instead of reporting them")
+	maxSize := flags.Int("maxSize", 1<<20, "report snapshots larger than this many bytes, or 0 to allow any size")
+	flags.Parse(args)
+
+	paths := flags.Args()
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+	var files []string
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil && info.IsDir() {
+			found, err := snapshotter.FindSnapshotFiles(path)
+			if err != nil {
+				return err
+			}
+			files = append(files, found...)
+			continue
+		}
+		files = append(files, path)
+	}
+
+	found := false
+	for _, file := range files {
+		problems, err := snapshotter.Lint(file, snapshotter.LintOptions{MaxSnapshotSize: *maxSize, Fix: *fix})
+		if err != nil {
+			return err
+		}
+		for _, problem := range problems {
+			fmt.Println(problem)
+			found = true
+		}
+	}
+	if found {
+		return errProblems
+	}
+	return nil
+}
@@ -0,0 +1,338 @@
+package snapshotter
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// DiffFormat selects how Verify reports the differences between expected and
+// actual snapshot values.
+type DiffFormat int
+
+const (
+	// DiffFormatLines reports a unified line diff of the pretty-printed values.
+	// It is the default.
+	DiffFormatLines DiffFormat = iota
+	// DiffFormatStructural reports every difference on its own line, by the
+	// JSON path of the changed value:
+	//
+	//	~ $.Values[1].Foo: "Bar" -> "Foo"
+	//	+ $.Values[1].Added: 1
+	//	- $.Values[1].Removed: true
+	//	> $.Values[0][3]: moved to [0]
+	//
+	// Arrays that differ in too many elements to align them are reported with
+	// a line diff instead.
+	DiffFormatStructural
+)
+
+// maxArrayDiffCells limits the size of the table used to align differing
+// array elements, which has a cell for each pair of elements that differ
+// between the common elements at the start and the end of both arrays.
+const maxArrayDiffCells = 1 << 20
+
+// diffValues returns a description of the differences between the expected
+// and actual values of a snapshot in format, or an empty string if they are
+// equal according to c.
+func diffValues(format DiffFormat, c *comparer, expected, actual []interface{}) string {
+	if c.valuesEqual(expected, actual) {
+		return ""
+	}
+	if format == DiffFormatLines {
+		return diffString(expected, actual)
+	}
+	d := structuralDiff{comparer: c}
+	d.diff(valuesPath, valuesPath.String(), toJSONValue(expected), toJSONValue(actual))
+	if d.tooLarge {
+		return diffString(expected, actual)
+	}
+	return d.String()
+}
+
+// valuesPath is the JSON path of the values of a snapshot.
+var valuesPath = jsonPath{keySegment("Values")}
+
+// toJSONValue converts a slice of values to the []interface{} representation
+// used by encoding/json, so it can be compared with other JSON values.
+func toJSONValue(values []interface{}) interface{} {
+	if values == nil {
+		return nil
+	}
+	return append([]interface{}{}, values...)
+}
+
+// structuralDiff collects the differences between two JSON values. Values are
+// identified by their path in the expected value, which is used to look up
+// tolerances, and by a label for display, which includes both indices of array
+// elements that are compared at different indices, e.g. "$.Values[2->3]".
+type structuralDiff struct {
+	*comparer
+	lines []string
+	// tooLarge is set if arrays differed in too many elements to align them.
+	tooLarge bool
+}
+
+func (d *structuralDiff) String() string {
+	if len(d.lines) == 0 {
+		return ""
+	}
+	return strings.Join(d.lines, "\n") + "\n"
+}
+
+// changed records a changed value. Numbers that differ by more than a
+// configured tolerance include the difference.
+func (d *structuralDiff) changed(path jsonPath, label string, expected, actual interface{}) {
+	line := fmt.Sprintf("~ %s: %s -> %s", label, formatJSONValue(expected), formatJSONValue(actual))
+	e, expectedIsNumber := expected.(float64)
+	a, actualIsNumber := actual.(float64)
+	if expectedIsNumber && actualIsNumber && d.toleranceAt(path) != (FloatTolerance{}) {
+		line += fmt.Sprintf(" (delta %g)", a-e)
+	}
+	d.lines = append(d.lines, line)
+}
+
+func (d *structuralDiff) added(label string, actual interface{}) {
+	d.lines = append(d.lines, fmt.Sprintf("+ %s: %s", label, formatJSONValue(actual)))
+}
+
+func (d *structuralDiff) removed(label string, expected interface{}) {
+	d.lines = append(d.lines, fmt.Sprintf("- %s: %s", label, formatJSONValue(expected)))
+}
+
+func (d *structuralDiff) moved(label string, from, to int) {
+	d.lines = append(d.lines, fmt.Sprintf("> %s[%d]: moved to [%d]", label, from, to))
+}
+
+// diff records the differences between expected and actual at path.
+func (d *structuralDiff) diff(path jsonPath, label string, expected, actual interface{}) {
+	switch e := expected.(type) {
+	case map[string]interface{}:
+		if a, ok := actual.(map[string]interface{}); ok {
+			d.diffObjects(path, label, e, a)
+			return
+		}
+	case []interface{}:
+		if a, ok := actual.([]interface{}); ok {
+			d.diffArrays(path, label, e, a)
+			return
+		}
+	}
+	if !d.equal(path, expected, actual) {
+		d.changed(path, label, expected, actual)
+	}
+}
+
+func (d *structuralDiff) diffObjects(path jsonPath, label string, expected, actual map[string]interface{}) {
+	keys := make([]string, 0, len(expected)+len(actual))
+	for key := range expected {
+		keys = append(keys, key)
+	}
+	for key := range actual {
+		if _, ok := expected[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		keyPath := path.child(keySegment(key))
+		keyLabel := label + formatKey(key)
+		e, inExpected := expected[key]
+		a, inActual := actual[key]
+		switch {
+		case !inActual:
+			d.removed(keyLabel, e)
+		case !inExpected:
+			d.added(keyLabel, a)
+		default:
+			d.diff(keyPath, keyLabel, e, a)
+		}
+	}
+}
+
+// diffArrays aligns the elements of two arrays using their longest common
+// subsequence. Unaligned elements that are equal to an unaligned element of
+// the other array are reported as moved. Remaining unaligned elements between
+// two aligned elements are compared pairwise, and any left over are reported
+// as added or removed.
+func (d *structuralDiff) diffArrays(path jsonPath, label string, expected, actual []interface{}) {
+	if d.equal(path, expected, actual) {
+		return
+	}
+
+	// Elements are compared using the path of the expected element.
+	elementsEqual := func(i, j int) bool {
+		return d.equal(path.child(indexSegment(i)), expected[i], actual[j])
+	}
+	common, ok := longestCommonSubsequence(len(expected), len(actual), elementsEqual)
+	if !ok {
+		d.tooLarge = true
+		return
+	}
+
+	// Collect the gaps between aligned elements.
+	type gap struct {
+		expected, actual []int
+	}
+	var gaps []gap
+	i, j := 0, 0
+	for _, match := range append(common, [2]int{len(expected), len(actual)}) {
+		var g gap
+		for ; i < match[0]; i++ {
+			g.expected = append(g.expected, i)
+		}
+		for ; j < match[1]; j++ {
+			g.actual = append(g.actual, j)
+		}
+		gaps = append(gaps, g)
+		i, j = match[0]+1, match[1]+1
+	}
+
+	// Find moved elements across all gaps.
+	movedExpected := make(map[int]bool)
+	movedActual := make(map[int]bool)
+	for _, g := range gaps {
+		for _, ei := range g.expected {
+		search:
+			for _, other := range gaps {
+				for _, aj := range other.actual {
+					if !movedActual[aj] && elementsEqual(ei, aj) {
+						movedExpected[ei], movedActual[aj] = true, true
+						d.moved(label, ei, aj)
+						break search
+					}
+				}
+			}
+		}
+	}
+
+	for _, g := range gaps {
+		var es, as []int
+		for _, ei := range g.expected {
+			if !movedExpected[ei] {
+				es = append(es, ei)
+			}
+		}
+		for _, aj := range g.actual {
+			if !movedActual[aj] {
+				as = append(as, aj)
+			}
+		}
+		for k := 0; k < len(es) || k < len(as); k++ {
+			switch {
+			case k >= len(as):
+				d.removed(formatIndex(label, es[k]), expected[es[k]])
+			case k >= len(es):
+				d.added(formatIndex(label, as[k]), actual[as[k]])
+			default:
+				d.diff(path.child(indexSegment(es[k])), formatPairedIndex(label, es[k], as[k]), expected[es[k]], actual[as[k]])
+			}
+		}
+	}
+}
+
+// longestCommonSubsequence returns the pairs of indices of equal elements in
+// the longest common subsequence of two sequences of lengths n and m, where
+// equal reports whether the i-th element of the first sequence equals the j-th
+// element of the second. Equal elements at the start and the end are matched
+// directly, and it reports false if the elements between them would need a
+// table of more than maxArrayDiffCells cells.
+func longestCommonSubsequence(n, m int, equal func(i, j int) bool) ([][2]int, bool) {
+	prefix := 0
+	for prefix < n && prefix < m && equal(prefix, prefix) {
+		prefix++
+	}
+	suffix := 0
+	for suffix < n-prefix && suffix < m-prefix && equal(n-1-suffix, m-1-suffix) {
+		suffix++
+	}
+	rows, columns := n-prefix-suffix, m-prefix-suffix
+	if rows > 0 && columns > maxArrayDiffCells/rows {
+		return nil, false
+	}
+
+	var common [][2]int
+	for i := 0; i < prefix; i++ {
+		common = append(common, [2]int{i, i})
+	}
+
+	// lengths[i][j] is the length of the longest common subsequence of the
+	// elements from prefix+i and prefix+j up to the suffix.
+	lengths := make([][]int, rows+1)
+	for i := range lengths {
+		lengths[i] = make([]int, columns+1)
+	}
+	for i := rows - 1; i >= 0; i-- {
+		for j := columns - 1; j >= 0; j-- {
+			if equal(prefix+i, prefix+j) {
+				lengths[i][j] = lengths[i+1][j+1] + 1
+			} else if lengths[i+1][j] >= lengths[i][j+1] {
+				lengths[i][j] = lengths[i+1][j]
+			} else {
+				lengths[i][j] = lengths[i][j+1]
+			}
+		}
+	}
+	for i, j := 0, 0; i < rows && j < columns; {
+		switch {
+		case equal(prefix+i, prefix+j):
+			common = append(common, [2]int{prefix + i, prefix + j})
+			i++
+			j++
+		case lengths[i+1][j] >= lengths[i][j+1]:
+			i++
+		default:
+			j++
+		}
+	}
+
+	for k := suffix; k > 0; k-- {
+		common = append(common, [2]int{n - k, m - k})
+	}
+	return common, true
+}
+
+// formatKey formats an object key as a JSON path segment.
+func formatKey(key string) string {
+	if isIdentifier(key) {
+		return "." + key
+	}
+	return "[" + strconv.Quote(key) + "]"
+}
+
+func formatIndex(path string, index int) string {
+	return fmt.Sprintf("%s[%d]", path, index)
+}
+
+// formatPairedIndex formats the index of two compared array elements. If their
+// indices differ, both are included, e.g. "$.Values[2->3]".
+func formatPairedIndex(path string, expected, actual int) string {
+	if expected == actual {
+		return formatIndex(path, expected)
+	}
+	return fmt.Sprintf("%s[%d->%d]", path, expected, actual)
+}
+
+func isIdentifier(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, r := range s {
+		if r != '_' && !unicode.IsLetter(r) && (i == 0 || !unicode.IsDigit(r)) {
+			return false
+		}
+	}
+	return true
+}
+
+// formatJSONValue formats a value as compact JSON.
+func formatJSONValue(value interface{}) string {
+	bytes, err := marshalJSON(value, "")
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(bytes)
+}
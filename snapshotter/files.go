@@ -0,0 +1,93 @@
+package snapshotter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// writeFileAtomically writes data to the file name by writing a temporary
+// file in the same directory and renaming it, so that the file is never seen
+// partially written.
+func writeFileAtomically(name string, data []byte, perm os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(name), "."+filepath.Base(name)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Chmod(f.Name(), perm); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), name); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+// claimedFiles holds the snapshot files claimed by Snapshotters that are
+// taking snapshots, by the path of the snapshot file without its extension.
+var claimedFiles = struct {
+	sync.Mutex
+	owners map[string]*Snapshotter
+}{owners: make(map[string]*Snapshotter)}
+
+// claim claims the snapshot file of s when it is verified, and reports
+// whether s may use it. Two Snapshotters would overwrite each other's
+// snapshots if they used the same snapshot file at the same time, so the file
+// may only be claimed by one Snapshotter until it is released by Verify. s.mu
+// must be held.
+func (s *Snapshotter) claim() bool {
+	s.t.Helper()
+	if s.claimed != "" {
+		return !s.conflict
+	}
+	s.claimed = s.snapshotDir()
+
+	claimedFiles.Lock()
+	defer claimedFiles.Unlock()
+	if owner, ok := claimedFiles.owners[s.claimed]; ok && owner != s {
+		s.conflict = true
+		s.t.Errorf("snapshot file %s is already used by another Snapshotter. Use NewNamed to give each Snapshotter its own snapshot file.", s.SnapshotFileName())
+		return false
+	}
+	claimedFiles.owners[s.claimed] = s
+	return true
+}
+
+// claimForTest claims the snapshot file of s when it takes its first
+// snapshot, and reports whether s may use it. The claim is only held until
+// Verify or the end of the test if t supports Cleanup; otherwise nothing
+// would release the file of a Snapshotter that is never verified, so it is
+// only claimed by Verify. s.mu must be held.
+func (s *Snapshotter) claimForTest() bool {
+	s.t.Helper()
+	if _, ok := s.t.(CleanupT); !ok {
+		return true
+	}
+	return s.claim()
+}
+
+// release releases the snapshot file claimed by s. s.mu must be held.
+func (s *Snapshotter) release() {
+	if s.claimed == "" {
+		return
+	}
+	claimedFiles.Lock()
+	defer claimedFiles.Unlock()
+	if claimedFiles.owners[s.claimed] == s {
+		delete(claimedFiles.owners, s.claimed)
+	}
+	s.claimed = ""
+	s.conflict = false
+}
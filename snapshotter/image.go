@@ -0,0 +1,436 @@
+package snapshotter
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"os"
+	"path/filepath"
+)
+
+// ImageComparison selects the metric VerifyWithImage uses to compare rendered
+// images against the stored images.
+type ImageComparison int
+
+const (
+	// ImageComparisonPixel compares images pixel by pixel, allowing each color
+	// channel to differ by ImageTolerance.Channel.
+	ImageComparisonPixel ImageComparison = iota
+	// ImageComparisonPerceptual compares images pixel by pixel using a
+	// perceptual color distance in the YIQ color space, allowing pixels to
+	// differ by ImageTolerance.Threshold. Pixels that only differ because of
+	// anti-aliasing are ignored.
+	ImageComparisonPerceptual
+	// ImageComparisonSSIM compares images by their structural similarity
+	// index, which must be at least ImageTolerance.MinSSIM.
+	ImageComparisonSSIM
+)
+
+// DefaultMinSSIM is the smallest structural similarity accepted by
+// ImageComparisonSSIM when ImageTolerance.MinSSIM is zero.
+const DefaultMinSSIM = 0.99
+
+// ImageTolerance configures how strictly VerifyWithImage compares rendered
+// images against the stored images. The zero value requires images to match
+// exactly, except for ImageComparisonSSIM, which uses DefaultMinSSIM.
+type ImageTolerance struct {
+	// Channel is the largest difference of any 8-bit color channel for which
+	// two pixels are still considered equal by ImageComparisonPixel.
+	Channel uint8
+	// Threshold is the largest perceptual distance, between 0 and 1, for which
+	// two pixels are still considered equal by ImageComparisonPerceptual. A
+	// threshold of 0.1 is a good starting point.
+	Threshold float64
+	// MaxDiffRatio is the largest ratio of differing pixels, between 0 and 1,
+	// for which two images are still considered equal by ImageComparisonPixel
+	// and ImageComparisonPerceptual.
+	MaxDiffRatio float64
+	// MinSSIM is the smallest structural similarity index, between 0 and 1,
+	// for which two images are still considered equal by ImageComparisonSSIM.
+	MinSSIM float64
+}
+
+// imageDiff is the result of comparing two images.
+type imageDiff struct {
+	// equal is whether the images are considered equal.
+	equal bool
+	// summary describes the computed score, for use in failure messages.
+	summary string
+	// diff highlights the differences between the images.
+	diff image.Image
+}
+
+var (
+	diffHighlight      = color.RGBA{R: 255, A: 255}
+	antialiasHighlight = color.RGBA{R: 255, G: 255, A: 255}
+)
+
+// compareImages compares two images of the same size using comparison.
+func compareImages(expected, actual image.Image, comparison ImageComparison, tolerance ImageTolerance) imageDiff {
+	e, a := toRGBA(expected), toRGBA(actual)
+	switch comparison {
+	case ImageComparisonPerceptual:
+		return comparePerceptual(e, a, tolerance)
+	case ImageComparisonSSIM:
+		return compareSSIM(e, a, tolerance)
+	default:
+		return comparePixels(e, a, tolerance)
+	}
+}
+
+// toRGBA converts img to an *image.RGBA with bounds starting at the origin, so
+// that images can be compared by their coordinates.
+func toRGBA(img image.Image) *image.RGBA {
+	bounds := img.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, bounds.Min, draw.Src)
+	return rgba
+}
+
+// summarizeRatio describes the ratio of differing pixels.
+func summarizeRatio(differing, total int, maxRatio float64) (bool, string) {
+	ratio := 0.0
+	if total > 0 {
+		ratio = float64(differing) / float64(total)
+	}
+	summary := fmt.Sprintf("%d of %d pixels (%.2f%%) differ, at most %.2f%% allowed", differing, total, 100*ratio, 100*maxRatio)
+	return differing == 0 || ratio <= maxRatio, summary
+}
+
+// comparePixels compares two images pixel by pixel. The diff image shows the
+// expected image faded, with differing pixels highlighted in red.
+func comparePixels(expected, actual *image.RGBA, tolerance ImageTolerance) imageDiff {
+	bounds := expected.Bounds()
+	diff := image.NewRGBA(bounds)
+
+	var differing int
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			e := expected.RGBAAt(x, y)
+			if !pixelsEqual(e, actual.RGBAAt(x, y), tolerance.Channel) {
+				differing++
+				diff.SetRGBA(x, y, diffHighlight)
+				continue
+			}
+			diff.Set(x, y, faded(e))
+		}
+	}
+	equal, summary := summarizeRatio(differing, bounds.Dx()*bounds.Dy(), tolerance.MaxDiffRatio)
+	return imageDiff{equal: equal, summary: summary, diff: diff}
+}
+
+func pixelsEqual(a, b color.RGBA, tolerance uint8) bool {
+	return channelDelta(a.R, b.R) <= tolerance &&
+		channelDelta(a.G, b.G) <= tolerance &&
+		channelDelta(a.B, b.B) <= tolerance &&
+		channelDelta(a.A, b.A) <= tolerance
+}
+
+func channelDelta(a, b uint8) uint8 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+// faded returns a light grayscale version of c, used as the background of
+// diff images.
+func faded(c color.Color) color.Color {
+	gray := color.GrayModel.Convert(c).(color.Gray)
+	return color.Gray{Y: 255 - (255-gray.Y)/4}
+}
+
+// maxYIQDelta is the largest possible value of yiqDelta.
+const maxYIQDelta = 35215
+
+// comparePerceptual compares two images pixel by pixel using the perceptual
+// color distance and anti-aliasing detection described in "Measuring perceived
+// color difference using YIQ NTSC transmission color space in mobile
+// applications" by Kotsarenko and Ramos, and "Anti-aliased pixel and intensity
+// slope detector" by Vysniauskas. The diff image highlights differing pixels
+// in red and ignored anti-aliased pixels in yellow.
+func comparePerceptual(expected, actual *image.RGBA, tolerance ImageTolerance) imageDiff {
+	bounds := expected.Bounds()
+	diff := image.NewRGBA(bounds)
+	maxDelta := maxYIQDelta * tolerance.Threshold * tolerance.Threshold
+
+	var differing, antialiased int
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			e := expected.RGBAAt(x, y)
+			delta := yiqDelta(e, actual.RGBAAt(x, y))
+			switch {
+			case delta <= maxDelta:
+				diff.Set(x, y, faded(e))
+			case isAntialiased(expected, x, y, actual) || isAntialiased(actual, x, y, expected):
+				antialiased++
+				diff.SetRGBA(x, y, antialiasHighlight)
+			default:
+				differing++
+				diff.SetRGBA(x, y, diffHighlight)
+			}
+		}
+	}
+	equal, summary := summarizeRatio(differing, bounds.Dx()*bounds.Dy(), tolerance.MaxDiffRatio)
+	return imageDiff{
+		equal:   equal,
+		summary: fmt.Sprintf("%s (%d anti-aliased pixels ignored)", summary, antialiased),
+		diff:    diff,
+	}
+}
+
+// blend blends a color channel with a white background according to alpha.
+func blend(c, alpha uint8) float64 {
+	return 255 + (float64(c)-255)*float64(alpha)/255
+}
+
+func yiq(c color.RGBA) (y, i, q float64) {
+	r, g, b := blend(c.R, c.A), blend(c.G, c.A), blend(c.B, c.A)
+	y = r*0.29889531 + g*0.58662247 + b*0.11448223
+	i = r*0.59597799 - g*0.27417610 - b*0.32180189
+	q = r*0.21147017 - g*0.52261711 + b*0.31114694
+	return y, i, q
+}
+
+// yiqDelta returns the squared perceptual distance between two colors.
+func yiqDelta(a, b color.RGBA) float64 {
+	if a == b {
+		return 0
+	}
+	ay, ai, aq := yiq(a)
+	by, bi, bq := yiq(b)
+	dy, di, dq := ay-by, ai-bi, aq-bq
+	return 0.5053*dy*dy + 0.299*di*di + 0.1957*dq*dq
+}
+
+// brightnessDelta returns the signed difference in brightness between two
+// colors.
+func brightnessDelta(a, b color.RGBA) float64 {
+	ay, _, _ := yiq(a)
+	by, _, _ := yiq(b)
+	return ay - by
+}
+
+// neighborhood returns the bounds of the 3x3 neighborhood of (x, y) within
+// bounds, and whether (x, y) is on the edge of bounds.
+func neighborhood(bounds image.Rectangle, x, y int) (image.Rectangle, bool) {
+	r := image.Rect(x-1, y-1, x+2, y+2).Intersect(bounds)
+	onEdge := r.Min.X == x || r.Max.X == x+1 || r.Min.Y == y || r.Max.Y == y+1
+	return r, onEdge
+}
+
+// isAntialiased reports whether the pixel at (x, y) in img is likely
+// anti-aliased: it sits on a slope between its darkest and brightest neighbors,
+// and one of those neighbors is part of a flat region in both images.
+func isAntialiased(img *image.RGBA, x, y int, other *image.RGBA) bool {
+	r, onEdge := neighborhood(img.Bounds(), x, y)
+	zeroes := 0
+	if onEdge {
+		zeroes = 1
+	}
+	center := img.RGBAAt(x, y)
+
+	var minDelta, maxDelta float64
+	var minX, minY, maxX, maxY int
+	for ny := r.Min.Y; ny < r.Max.Y; ny++ {
+		for nx := r.Min.X; nx < r.Max.X; nx++ {
+			if nx == x && ny == y {
+				continue
+			}
+			delta := brightnessDelta(center, img.RGBAAt(nx, ny))
+			switch {
+			case delta == 0:
+				zeroes++
+				// More than two equal neighbors means the pixel isn't on a slope.
+				if zeroes > 2 {
+					return false
+				}
+			case delta < minDelta:
+				minDelta, minX, minY = delta, nx, ny
+			case delta > maxDelta:
+				maxDelta, maxX, maxY = delta, nx, ny
+			}
+		}
+	}
+
+	// Without both a darker and a brighter neighbor, the pixel isn't on a slope.
+	if minDelta == 0 || maxDelta == 0 {
+		return false
+	}
+
+	return (hasManySiblings(img, minX, minY) && hasManySiblings(other, minX, minY)) ||
+		(hasManySiblings(img, maxX, maxY) && hasManySiblings(other, maxX, maxY))
+}
+
+// hasManySiblings reports whether the pixel at (x, y) has more than two
+// neighbors of exactly the same color.
+func hasManySiblings(img *image.RGBA, x, y int) bool {
+	r, onEdge := neighborhood(img.Bounds(), x, y)
+	zeroes := 0
+	if onEdge {
+		zeroes = 1
+	}
+	center := img.RGBAAt(x, y)
+	for ny := r.Min.Y; ny < r.Max.Y; ny++ {
+		for nx := r.Min.X; nx < r.Max.X; nx++ {
+			if nx == x && ny == y {
+				continue
+			}
+			if img.RGBAAt(nx, ny) == center {
+				zeroes++
+			}
+			if zeroes > 2 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ssimWindowSize is the size of the square windows over which the structural
+// similarity index is computed.
+const ssimWindowSize = 8
+
+// compareSSIM compares two images by their mean structural similarity index,
+// computed over the luminance of non-overlapping windows. The diff image
+// highlights windows whose similarity is below the minimum in red.
+func compareSSIM(expected, actual *image.RGBA, tolerance ImageTolerance) imageDiff {
+	minSSIM := tolerance.MinSSIM
+	if minSSIM == 0 {
+		minSSIM = DefaultMinSSIM
+	}
+
+	bounds := expected.Bounds()
+	diff := image.NewRGBA(bounds)
+	var sum float64
+	var windows int
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += ssimWindowSize {
+		for x := bounds.Min.X; x < bounds.Max.X; x += ssimWindowSize {
+			window := image.Rect(x, y, x+ssimWindowSize, y+ssimWindowSize).Intersect(bounds)
+			score := windowSSIM(expected, actual, window)
+			sum += score
+			windows++
+			for wy := window.Min.Y; wy < window.Max.Y; wy++ {
+				for wx := window.Min.X; wx < window.Max.X; wx++ {
+					if score < minSSIM {
+						diff.SetRGBA(wx, wy, diffHighlight)
+					} else {
+						diff.Set(wx, wy, faded(expected.RGBAAt(wx, wy)))
+					}
+				}
+			}
+		}
+	}
+
+	ssim := 1.0
+	if windows > 0 {
+		ssim = sum / float64(windows)
+	}
+	return imageDiff{
+		equal:   ssim >= minSSIM,
+		summary: fmt.Sprintf("SSIM is %.4f, at least %.4f required", ssim, minSSIM),
+		diff:    diff,
+	}
+}
+
+// windowSSIM computes the structural similarity index of the luminance of two
+// images within window.
+func windowSSIM(a, b *image.RGBA, window image.Rectangle) float64 {
+	const (
+		c1 = (0.01 * 255) * (0.01 * 255)
+		c2 = (0.03 * 255) * (0.03 * 255)
+	)
+
+	n := float64(window.Dx() * window.Dy())
+	var sumA, sumB, sumAA, sumBB, sumAB float64
+	for y := window.Min.Y; y < window.Max.Y; y++ {
+		for x := window.Min.X; x < window.Max.X; x++ {
+			la, _, _ := yiq(a.RGBAAt(x, y))
+			lb, _, _ := yiq(b.RGBAAt(x, y))
+			sumA += la
+			sumB += lb
+			sumAA += la * la
+			sumBB += lb * lb
+			sumAB += la * lb
+		}
+	}
+	meanA, meanB := sumA/n, sumB/n
+	varA := sumAA/n - meanA*meanA
+	varB := sumBB/n - meanB*meanB
+	covariance := sumAB/n - meanA*meanB
+	return ((2*meanA*meanB + c1) * (2*covariance + c2)) /
+		((meanA*meanA + meanB*meanB + c1) * (varA + varB + c2))
+}
+
+func readPNG(path string) (image.Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return png.Decode(f)
+}
+
+func writePNG(path string, img image.Image) error {
+	var buffer bytes.Buffer
+	if err := png.Encode(&buffer, img); err != nil {
+		return err
+	}
+	return writeFileAtomically(path, buffer.Bytes(), 0644)
+}
+
+// diffImageExtension is the extension of the images highlighting the pixels
+// in which a rendered image differs from the stored image.
+const diffImageExtension = ".diff.png"
+
+// verifyImages renders each snapshot and compares it against the PNG stored in
+// dir. When an image differs, a diff image highlighting the changed pixels is
+// written next to it.
+func (s *Snapshotter) verifyImages(dir string, renderFn RenderFn) {
+	s.t.Helper()
+	for _, snap := range s.snapshots {
+		if snap.Binary {
+			continue
+		}
+		sanitizedName := sanitizeForPath(snap.Name)
+		pngPath := filepath.Join(dir, sanitizedName+".png")
+		diffPath := filepath.Join(dir, sanitizedName+diffImageExtension)
+
+		actual, err := renderFn(snap.Values)
+		if err != nil {
+			s.t.Errorf("error rendering image for snapshot %s: %s", snap.Name, err)
+			continue
+		}
+
+		expected, err := readPNG(pngPath)
+		if os.IsNotExist(err) {
+			s.t.Errorf("missing image %s for snapshot %s", pngPath, snap.Name)
+			continue
+		} else if err != nil {
+			s.t.Errorf("error reading image %s: %s", pngPath, err)
+			continue
+		}
+
+		if expected.Bounds().Size() != actual.Bounds().Size() {
+			s.t.Errorf("image for snapshot %s differs: expected size %v, got %v", snap.Name, expected.Bounds().Size(), actual.Bounds().Size())
+			continue
+		}
+
+		result := compareImages(expected, actual, s.ImageComparison, s.ImageTolerance)
+		if result.equal {
+			if err := os.Remove(diffPath); err != nil && !os.IsNotExist(err) {
+				s.t.Errorf("failed to remove stale diff image %s: %s", diffPath, err)
+			}
+			continue
+		}
+
+		if err := writePNG(diffPath, result.diff); err != nil {
+			s.t.Errorf("error writing diff image %s: %s", diffPath, err)
+		}
+		s.t.Errorf("image for snapshot %s differs: %s; see %s", snap.Name, result.summary, diffPath)
+		s.t.Errorf("If this is intentional, you can run `go test . -rewriteSnapshots` to generate new snapshots.")
+	}
+}
@@ -0,0 +1,304 @@
+package snapshotter
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Inline compares value against expected, a string literal written at the
+// call site. Strings are compared as-is, and other values are compared as
+// compact JSON, so Inline is best suited for small values:
+//
+//	snapshotter.Inline(t, user.Name, "gopher")
+//	snapshotter.Inline(t, ids, "[1,2,3]")
+//
+// When rewriting snapshots, Inline updates the literal in the test's source
+// file instead of failing the test. When writing new snapshots, only empty
+// literals are updated. The expected literal must be a string literal for it
+// to be rewritten.
+func Inline(t T, value interface{}, expected string) {
+	t.Helper()
+	mode, err := GlobalSnapshotMode()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	actual, err := formatInline(value)
+	if err != nil {
+		t.Errorf("error formatting inline snapshot value %v: %s", value, err)
+		return
+	}
+
+	isNew := expected == "" && actual != ""
+	if mode == SnapshotModeWriteNew && isNew {
+		mode = SnapshotModeRewrite
+	}
+
+	if mode == SnapshotModeRewrite || mode == SnapshotModeCheckAndRewrite {
+		pcs := make([]uintptr, 1)
+		if runtime.Callers(2, pcs) == 0 {
+			t.Errorf("error rewriting inline snapshot: unknown call site")
+		} else if err := inlineRewrites.record(pcs[0], expected, actual); err != nil {
+			t.Errorf("error rewriting inline snapshot: %s", err)
+		}
+	}
+
+	if mode == SnapshotModeRewrite || actual == expected {
+		return
+	}
+	if mode == SnapshotModeCI && isNew {
+		t.Errorf("inline snapshot %q was never committed. Run `go test . -rewriteSnapshots` locally and commit it.", actual)
+		return
+	}
+	t.Errorf("inline snapshot differs:\n%s", diffString(expected, actual))
+	t.Errorf("If this is intentional, you can run `go test . -rewriteSnapshots` to generate new snapshots.")
+}
+
+// formatInline formats a value for an inline snapshot.
+func formatInline(value interface{}) (string, error) {
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+	roundtripped, err := jsonRoundTrip(value)
+	if err != nil {
+		return "", err
+	}
+	bytes, err := marshalJSON(roundtripped, "")
+	if err != nil {
+		return "", err
+	}
+	return string(bytes), nil
+}
+
+// inlineRewrites holds the inline snapshots rewritten by this test binary.
+var inlineRewrites = &inlineRewriter{files: make(map[string]*inlineFile)}
+
+// inlineRewriter rewrites the expected literals of Inline calls in source
+// files. Line numbers reported by the runtime refer to the source files as
+// they were compiled, so each file is parsed once, and is then regenerated
+// from its original source with all of the rewrites recorded so far.
+type inlineRewriter struct {
+	mu    sync.Mutex
+	files map[string]*inlineFile
+}
+
+// inlineFile is a source file containing Inline calls.
+type inlineFile struct {
+	path string
+	src  []byte
+	fset *token.FileSet
+	// calls are the Inline calls in the file, in source order.
+	calls []*ast.CallExpr
+	// rewrites are the rewritten values of Inline calls by call site.
+	rewrites map[uintptr]*inlineRewrite
+}
+
+// inlineRewrite is the value of an Inline call that is written back to the
+// source file.
+type inlineRewrite struct {
+	pc       uintptr
+	line     int
+	expected string
+	actual   string
+}
+
+// record records the actual value of the Inline call at pc and rewrites the
+// source file containing the call.
+func (r *inlineRewriter) record(pc uintptr, expected, actual string) error {
+	frame, _ := runtime.CallersFrames([]uintptr{pc}).Next()
+	if frame.File == "" {
+		return errors.New("unknown call site")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	f, ok := r.files[frame.File]
+	if !ok {
+		var err error
+		if f, err = parseInlineFile(frame.File); err != nil {
+			return err
+		}
+		r.files[frame.File] = f
+	}
+
+	if previous, ok := f.rewrites[pc]; ok {
+		if previous.actual != actual {
+			return fmt.Errorf("%s:%d: called more than once with different values", frame.File, frame.Line)
+		}
+		return nil
+	}
+	f.rewrites[pc] = &inlineRewrite{pc: pc, line: frame.Line, expected: expected, actual: actual}
+	return f.write()
+}
+
+// parseInlineFile parses the source file at path.
+func parseInlineFile(path string) (*inlineFile, error) {
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseInlineSource(path, src)
+}
+
+// parseInlineSource parses src, the source of the file at path.
+func parseInlineSource(path string, src []byte) (*inlineFile, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, path, src, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &inlineFile{
+		path:     path,
+		src:      src,
+		fset:     fset,
+		rewrites: make(map[uintptr]*inlineRewrite),
+	}
+	ast.Inspect(file, func(node ast.Node) bool {
+		if call, ok := node.(*ast.CallExpr); ok && isInlineCall(call) {
+			f.calls = append(f.calls, call)
+		}
+		return true
+	})
+	return f, nil
+}
+
+// isInlineCall reports whether call is a call to Inline, either qualified
+// with a package name or from within this package.
+func isInlineCall(call *ast.CallExpr) bool {
+	if len(call.Args) != 3 {
+		return false
+	}
+	switch fun := call.Fun.(type) {
+	case *ast.SelectorExpr:
+		return fun.Sel.Name == "Inline"
+	case *ast.Ident:
+		return fun.Name == "Inline"
+	}
+	return false
+}
+
+// write writes the rewritten source to the file.
+func (f *inlineFile) write() error {
+	src, err := f.rewrite()
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(f.path, src, info.Mode())
+}
+
+// rewrite replaces the literals of all rewritten calls in the original source
+// and formats it. Only the literals are replaced, so the rest of the file is
+// left as it was written.
+func (f *inlineFile) rewrite() ([]byte, error) {
+	// Group rewrites by line. Calls on the same line are assigned in the order
+	// of their call sites, which follows the order of the calls in the source,
+	// to the first unassigned call whose literal has the expected value.
+	var edits []inlineEdit
+	byLine := make(map[int][]*inlineRewrite)
+	for _, rewrite := range f.rewrites {
+		byLine[rewrite.line] = append(byLine[rewrite.line], rewrite)
+	}
+	for line, rewrites := range byLine {
+		sort.Slice(rewrites, func(i, j int) bool { return rewrites[i].pc < rewrites[j].pc })
+
+		assigned := make(map[*ast.CallExpr]bool)
+		for _, rewrite := range rewrites {
+			call, err := f.findCall(line, rewrite.expected, assigned)
+			if err != nil {
+				return nil, err
+			}
+			assigned[call] = true
+			lit := call.Args[2]
+			edits = append(edits, inlineEdit{
+				start: f.fset.Position(lit.Pos()).Offset,
+				end:   f.fset.Position(lit.End()).Offset,
+				value: quoteInline(rewrite.actual),
+			})
+		}
+	}
+
+	sort.Slice(edits, func(i, j int) bool { return edits[i].start < edits[j].start })
+	var buffer bytes.Buffer
+	offset := 0
+	for _, edit := range edits {
+		buffer.Write(f.src[offset:edit.start])
+		buffer.WriteString(edit.value)
+		offset = edit.end
+	}
+	buffer.Write(f.src[offset:])
+	return format.Source(buffer.Bytes())
+}
+
+// inlineEdit replaces the bytes of the source between start and end.
+type inlineEdit struct {
+	start, end int
+	value      string
+}
+
+// findCall returns the first unassigned Inline call spanning line whose
+// expected literal has the value expected.
+func (f *inlineFile) findCall(line int, expected string, assigned map[*ast.CallExpr]bool) (*ast.CallExpr, error) {
+	found := false
+	for _, call := range f.calls {
+		if f.fset.Position(call.Pos()).Line > line || f.fset.Position(call.End()).Line < line {
+			continue
+		}
+		found = true
+		lit, ok := call.Args[2].(*ast.BasicLit)
+		if !ok || lit.Kind != token.STRING {
+			continue
+		}
+		value, err := strconv.Unquote(lit.Value)
+		if err != nil || value != expected || assigned[call] {
+			continue
+		}
+		return call, nil
+	}
+	if !found {
+		return nil, fmt.Errorf("%s:%d: no call to Inline found", f.path, line)
+	}
+	return nil, fmt.Errorf("%s:%d: expected value of Inline must be a string literal", f.path, line)
+}
+
+// quoteInline returns a Go string literal for s. Multi-line strings are
+// written as raw string literals where possible to keep them readable.
+func quoteInline(s string) string {
+	if strings.Contains(s, "\n") && canBackquoteLines(s) {
+		return "`" + s + "`"
+	}
+	return strconv.Quote(s)
+}
+
+// canBackquoteLines reports whether s can be written as a multi-line raw
+// string literal without changing its value.
+func canBackquoteLines(s string) bool {
+	if !utf8.ValidString(s) {
+		return false
+	}
+	for _, r := range s {
+		if r == '`' || r == '\r' || r == '\uFEFF' || (r < ' ' && r != '\t' && r != '\n') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,171 @@
+package snapshotter
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// inlineTestSource is a test using inline snapshots, which is deliberately not
+// formatted and has multiple calls on some lines.
+const inlineTestSource = `package inline_test
+
+import (
+	"testing"
+
+	"github.com/samsarahq/go/snapshotter"
+)
+
+func TestInline(t *testing.T) {
+	snapshotter.Inline(t, "a", ""); snapshotter.Inline(t, "b", "")
+	snapshotter.Inline(t, "b", "a"); snapshotter.Inline(t, "a", "a")
+	snapshotter.Inline(t, map[string]int{"x": 1},
+		"old")
+	snapshotter.Inline(t, "line 1\nline 2", "")
+	for i := 0; i < 2; i++ {
+		snapshotter.Inline(t, "same", "") // Called twice.
+	}
+}
+`
+
+const inlineTestRewritten = `package inline_test
+
+import (
+	"testing"
+
+	"github.com/samsarahq/go/snapshotter"
+)
+
+func TestInline(t *testing.T) {
+	snapshotter.Inline(t, "a", "a")
+	snapshotter.Inline(t, "b", "b")
+	snapshotter.Inline(t, "b", "b")
+	snapshotter.Inline(t, "a", "a")
+	snapshotter.Inline(t, map[string]int{"x": 1},
+		"{\"x\":1}")
+	snapshotter.Inline(t, "line 1\nline 2", ` + "`line 1\nline 2`" + `)
+	for i := 0; i < 2; i++ {
+		snapshotter.Inline(t, "same", "same") // Called twice.
+	}
+}
+`
+
+func TestInlineRewrite(t *testing.T) {
+	testCases := []struct {
+		name   string
+		source string
+		// rewrites are the Inline calls to rewrite, in the order of their call
+		// sites.
+		rewrites []inlineRewrite
+		expected string
+		err      string
+	}{
+		{
+			name:   "rewrites",
+			source: inlineTestSource,
+			rewrites: []inlineRewrite{
+				{line: 10, expected: "", actual: "a"},
+				{line: 10, expected: "", actual: "b"},
+				{line: 11, expected: "a", actual: "b"},
+				{line: 11, expected: "a", actual: "a"},
+				// Calls spanning several lines are found by any of their
+				// lines.
+				{line: 13, expected: "old", actual: `{"x":1}`},
+				{line: 14, expected: "", actual: "line 1\nline 2"},
+				{line: 16, expected: "", actual: "same"},
+			},
+			expected: inlineTestRewritten,
+		},
+		{
+			name:     "no call",
+			source:   inlineTestSource,
+			rewrites: []inlineRewrite{{line: 9, expected: "", actual: "a"}},
+			err:      "inline_test.go:9: no call to Inline found",
+		},
+		{
+			name:     "literal with another value",
+			source:   inlineTestSource,
+			rewrites: []inlineRewrite{{line: 11, expected: "c", actual: "a"}},
+			err:      "inline_test.go:11: expected value of Inline must be a string literal",
+		},
+		{
+			name:     "not a literal",
+			source:   "package inline_test\n\nfunc TestInline(t *testing.T) {\n\tInline(t, 1, expected)\n}\n",
+			rewrites: []inlineRewrite{{line: 4, expected: "", actual: "1"}},
+			err:      "inline_test.go:4: expected value of Inline must be a string literal",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			f, err := parseInlineSource("inline_test.go", []byte(tc.source))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, rewrite := range tc.rewrites {
+				rewrite := rewrite
+				rewrite.pc = uintptr(i + 1)
+				f.rewrites[rewrite.pc] = &rewrite
+			}
+
+			rewritten, err := f.rewrite()
+			if tc.err != "" {
+				if err == nil || err.Error() != tc.err {
+					t.Errorf("expected error %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(rewritten) != tc.expected {
+				t.Errorf("expected:\n%s\ngot:\n%s", tc.expected, rewritten)
+			}
+		})
+	}
+}
+
+// TestInlineRewriteEndToEnd rewrites the source of a test run by go test, to
+// check that the call sites reported by the runtime are found in the source.
+func TestInlineRewriteEndToEnd(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test that runs go test in short mode")
+	}
+
+	moduleDir, err := filepath.Abs("..")
+	if err != nil {
+		t.Fatal(err)
+	}
+	goSum, err := ioutil.ReadFile(filepath.Join(moduleDir, "go.sum"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"go.mod":         "module inline\n\ngo 1.17\n\nrequire github.com/samsarahq/go v0.0.0\n\nreplace github.com/samsarahq/go => " + moduleDir + "\n",
+		"go.sum":         string(goSum),
+		"inline_test.go": inlineTestSource,
+	}
+	for name, contents := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cmd := exec.Command("go", "test", "-count=1", ".")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GOFLAGS=-mod=mod", "REWRITE_SNAPSHOTS=1")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go test failed: %s\n%s", err, output)
+	}
+	rewritten, err := ioutil.ReadFile(filepath.Join(dir, "inline_test.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rewritten) != inlineTestRewritten {
+		t.Errorf("expected:\n%s\ngot:\n%s", inlineTestRewritten, rewritten)
+	}
+}
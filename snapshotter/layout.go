@@ -0,0 +1,96 @@
+package snapshotter
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// defaultSnapshotDir is the directory holding snapshot files when SnapshotDir
+// is not set.
+const defaultSnapshotDir = "testdata"
+
+// FileNameFunc returns the path of the snapshot file of the test named test,
+// relative to the snapshot directory and without the ".snapshots.<extension>"
+// suffix. name is the name passed to NewNamed, or an empty string.
+type FileNameFunc func(test, name string) string
+
+// FlatFileName names snapshot files after the test, its subtests and the name
+// of the Snapshotter, such as "TestFoo-case_1_name", so that all snapshot
+// files are stored directly in the snapshot directory. It is the default.
+func FlatFileName(test, name string) string {
+	fileName := sanitizeForPath(test)
+	if name != "" {
+		fileName += "_" + sanitizeForPath(name)
+	}
+	return fileName
+}
+
+// NestedFileName stores the snapshot files of subtests in a directory named
+// after their parent test, such as "TestFoo/case_1/subcase_name", so that
+// tests with many subtests don't fill the snapshot directory.
+func NestedFileName(test, name string) string {
+	elements := strings.Split(test, "/")
+	for i, element := range elements {
+		elements[i] = sanitizeForPath(element)
+	}
+	if name != "" {
+		elements[len(elements)-1] += "_" + sanitizeForPath(name)
+	}
+	return filepath.Join(elements...)
+}
+
+// PackageFileName stores the snapshot files named by fileName in a directory
+// named after the package directory relative to the root of its module, such
+// as "pkg/server/TestFoo". It keeps the snapshot files of packages apart when
+// they share a SnapshotDir, such as a directory at the root of the module.
+func PackageFileName(fileName FileNameFunc) FileNameFunc {
+	return func(test, name string) string {
+		return filepath.Join(packageDir(), fileName(test, name))
+	}
+}
+
+// packageDir returns the working directory of the test, which is the
+// directory of the package being tested, relative to the root of its module.
+// Outside of a module it returns the name of the working directory.
+func packageDir() string {
+	wd, err := os.Getwd()
+	if err != nil {
+		return "."
+	}
+	for dir := wd; ; dir = filepath.Dir(dir) {
+		if _, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil {
+			if rel, err := filepath.Rel(dir, wd); err == nil {
+				return rel
+			}
+			break
+		}
+		if filepath.Dir(dir) == dir {
+			break
+		}
+	}
+	return filepath.Base(wd)
+}
+
+// snapshotRoot returns the directory holding the snapshot files of s.
+func (s *Snapshotter) snapshotRoot() string {
+	if s.SnapshotDir != "" {
+		return s.SnapshotDir
+	}
+	return defaultSnapshotDir
+}
+
+// fileName returns the naming scheme of the snapshot files of s.
+func (s *Snapshotter) fileName() FileNameFunc {
+	if s.FileName != nil {
+		return s.FileName
+	}
+	return FlatFileName
+}
+
+// isInPackage reports whether the directory dir is inside the package
+// directory.
+func isInPackage(dir string) bool {
+	dir = filepath.Clean(dir)
+	return !filepath.IsAbs(dir) && dir != ".." && !strings.HasPrefix(dir, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,215 @@
+package snapshotter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// serializers are the built-in Serializers by the extension of their snapshot
+// files.
+var serializers = map[string]Serializer{
+	SerializerJSON.Extension():     SerializerJSON,
+	SerializerYAML.Extension():     SerializerYAML,
+	SerializerGoSyntax.Extension(): SerializerGoSyntax,
+}
+
+// LintOptions configures Lint.
+type LintOptions struct {
+	// MaxSnapshotSize is the size in bytes above which snapshots are reported
+	// as oversized. Zero disables the check.
+	MaxSnapshotSize int
+	// Fix formats snapshot files canonically instead of reporting them.
+	Fix bool
+}
+
+// LintProblem is a problem found in a snapshot file by Lint.
+type LintProblem struct {
+	// File is the path of the snapshot file.
+	File string
+	// Snapshot is the name of the snapshot with the problem, if the problem
+	// is not with the snapshot file as a whole.
+	Snapshot string
+	Message  string
+}
+
+func (p LintProblem) String() string {
+	if p.Snapshot == "" {
+		return fmt.Sprintf("%s: %s", p.File, p.Message)
+	}
+	return fmt.Sprintf("%s: snapshot %s: %s", p.File, p.Snapshot, p.Message)
+}
+
+// FindSnapshotFiles returns the snapshot files in dir and its subdirectories
+// that are stored with one of the built-in Serializers. Hidden directories and
+// vendor directories are skipped.
+func FindSnapshotFiles(dir string) ([]string, error) {
+	var files []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path != dir && (strings.HasPrefix(info.Name(), ".") || info.Name() == "vendor") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if _, ok := snapshotFileStem(path); ok && serializers[strings.TrimPrefix(filepath.Ext(path), ".")] != nil {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// Lint checks the snapshot file name without running its test. It reports
+// snapshot files that don't parse, entries with unknown fields or fields of
+// the wrong type, snapshots without a name or with a missing file, snapshots
+// sharing a name, which are matched by the order in which they were taken,
+// oversized snapshots and snapshot files that are not formatted like Verify
+// would write them. Snapshot files with malformed entries are not formatted,
+// because formatting would drop the unknown fields. Errors reading or writing
+// the snapshot file are returned.
+func Lint(name string, options LintOptions) ([]LintProblem, error) {
+	serializer, ok := serializers[strings.TrimPrefix(filepath.Ext(name), ".")]
+	if _, isSnapshotFile := snapshotFileStem(name); !ok || !isSnapshotFile {
+		return nil, fmt.Errorf("%s is not a snapshot file", name)
+	}
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots, err := serializer.Unmarshal(data)
+	if err != nil {
+		return []LintProblem{{File: name, Message: fmt.Sprintf("error unmarshaling snapshots: %s", err)}}, nil
+	}
+
+	var problems []LintProblem
+	report := func(snapshot, format string, args ...interface{}) {
+		problems = append(problems, LintProblem{File: name, Snapshot: snapshot, Message: fmt.Sprintf(format, args...)})
+	}
+	if malformed := malformedEntries(serializer, data); len(malformed) > 0 {
+		for _, message := range malformed {
+			report("", "%s", message)
+		}
+		return problems, nil
+	}
+	seen := make(map[string]bool)
+	for _, snapshot := range snapshots {
+		if snapshot.Name == "" {
+			report("", "snapshot without a name")
+		} else if seen[snapshot.Name] {
+			report(snapshot.Name, "duplicate snapshot name. Snapshots sharing a name are compared in the order in which they were taken, so give each snapshot its own name.")
+		}
+		seen[snapshot.Name] = true
+
+		size, err := storedSize(serializer, filepath.Dir(name), snapshot)
+		switch {
+		case err != nil:
+			report(snapshot.Name, "%s", err)
+		case options.MaxSnapshotSize > 0 && size > options.MaxSnapshotSize:
+			report(snapshot.Name, "snapshot is %d bytes, more than the maximum of %d bytes", size, options.MaxSnapshotSize)
+		}
+	}
+
+	formatted, err := serializer.Marshal(snapshots)
+	if err != nil {
+		report("", "error marshaling snapshots: %s", err)
+	} else if !bytes.Equal(formatted, data) {
+		if !options.Fix {
+			report("", "snapshot file is not formatted canonically")
+		} else if err := writeFileAtomically(name, formatted, info.Mode().Perm()); err != nil {
+			return nil, err
+		}
+	}
+	return problems, nil
+}
+
+// lintSnapshot is a snapshot as stored in a JSON snapshot file, used to find
+// entries that don't match it.
+type lintSnapshot struct {
+	Name   string
+	Values []interface{}
+	File   string
+	Binary bool
+}
+
+// malformedEntries describes the entries of the snapshot file data that have
+// unknown fields or fields of the wrong type, or that are not snapshots at
+// all. Snapshot files of SerializerGoSyntax have no fields, so their entries
+// are only checked by unmarshaling them.
+func malformedEntries(serializer Serializer, data []byte) []string {
+	var messages []string
+	switch serializer.(type) {
+	case jsonSerializer:
+		var entries []json.RawMessage
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return []string{fmt.Sprintf("malformed snapshot file: %s", err)}
+		}
+		for i, entry := range entries {
+			var snapshot *lintSnapshot
+			decoder := json.NewDecoder(bytes.NewReader(entry))
+			decoder.DisallowUnknownFields()
+			if err := decoder.Decode(&snapshot); err != nil {
+				messages = append(messages, fmt.Sprintf("malformed entry %d: %s", i, err))
+			} else if snapshot == nil {
+				messages = append(messages, fmt.Sprintf("malformed entry %d: not a snapshot", i))
+			}
+		}
+	case yamlSerializer:
+		var entries []*yamlSnapshot
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		err := decoder.Decode(&entries)
+		if typeErr, ok := err.(*yaml.TypeError); ok {
+			for _, message := range typeErr.Errors {
+				messages = append(messages, fmt.Sprintf("malformed entry: %s", message))
+			}
+		} else if err != nil && err != io.EOF {
+			messages = append(messages, fmt.Sprintf("malformed snapshot file: %s", err))
+		}
+		for i, entry := range entries {
+			if entry == nil {
+				messages = append(messages, fmt.Sprintf("malformed entry %d: not a snapshot", i))
+			}
+		}
+	}
+	return messages
+}
+
+// storedSize returns the number of bytes snapshot takes up in the snapshot
+// directory dir when stored with serializer, including the file holding its
+// value if it is stored in a separate file.
+func storedSize(serializer Serializer, dir string, snapshot *Snapshot) (int, error) {
+	if snapshot.File != "" {
+		info, err := os.Stat(filepath.Join(dir, filepath.FromSlash(snapshot.File)))
+		if err != nil {
+			return 0, err
+		}
+		return int(info.Size()), nil
+	}
+	if snapshot.Binary {
+		return 0, fmt.Errorf("byte snapshot without a file")
+	}
+	data, err := serializer.Marshal([]*Snapshot{snapshot})
+	if err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
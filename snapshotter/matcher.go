@@ -0,0 +1,131 @@
+package snapshotter
+
+import (
+	"regexp"
+	"time"
+)
+
+// A Matcher replaces values at a JSON path with a placeholder before they are
+// stored in the snapshot file and compared, so that volatile values such as
+// timestamps and generated IDs don't make snapshots differ. Values that don't
+// match are kept as-is, so Verify still reports them.
+//
+// Only the placeholder is stored in the snapshot file, not the Matcher that
+// produced it. Verify checks the shape of values with the Matchers of the
+// Snapshotter, so changing what a Matcher accepts without changing its
+// placeholder doesn't make stored snapshots differ.
+type Matcher struct {
+	// Path is the JSON path of the values to replace, such as
+	// "$.Values[0].CreatedAt" or "$.Values[*].Users[*].ID". See Snapshot for
+	// how paths are rooted.
+	Path string
+	// Placeholder replaces the matching values.
+	Placeholder string
+	// Match reports whether a value should be replaced. Values are passed as
+	// decoded from JSON. If Match is nil, every value at Path is replaced.
+	Match func(value interface{}) bool
+}
+
+// Ignore returns a Matcher that replaces any value at path with "<ignored>".
+func Ignore(path string) Matcher {
+	return Placeholder(path, "<ignored>")
+}
+
+// Placeholder returns a Matcher that replaces any value at path with
+// placeholder.
+func Placeholder(path string, placeholder string) Matcher {
+	return Matcher{Path: path, Placeholder: placeholder}
+}
+
+// MatchRegexp returns a Matcher that replaces strings at path that match re
+// with "<name>".
+func MatchRegexp(path string, name string, re *regexp.Regexp) Matcher {
+	return Matcher{
+		Path:        path,
+		Placeholder: "<" + name + ">",
+		Match: func(value interface{}) bool {
+			str, ok := value.(string)
+			return ok && re.MatchString(str)
+		},
+	}
+}
+
+var uuidRegexp = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// AnyUUID returns a Matcher that replaces UUID strings at path with
+// "<any UUID>".
+func AnyUUID(path string) Matcher {
+	return MatchRegexp(path, "any UUID", uuidRegexp)
+}
+
+// AnyRFC3339Time returns a Matcher that replaces RFC 3339 timestamps at path,
+// such as the JSON encoding of a time.Time, with "<any RFC3339 time>".
+func AnyRFC3339Time(path string) Matcher {
+	return Matcher{
+		Path:        path,
+		Placeholder: "<any RFC3339 time>",
+		Match: func(value interface{}) bool {
+			str, ok := value.(string)
+			if !ok {
+				return false
+			}
+			_, err := time.Parse(time.RFC3339Nano, str)
+			return err == nil
+		},
+	}
+}
+
+// AnyString returns a Matcher that replaces strings at path with
+// "<any string>".
+func AnyString(path string) Matcher {
+	return Matcher{
+		Path:        path,
+		Placeholder: "<any string>",
+		Match: func(value interface{}) bool {
+			_, ok := value.(string)
+			return ok
+		},
+	}
+}
+
+// AnyNumber returns a Matcher that replaces numbers at path with
+// "<any number>".
+func AnyNumber(path string) Matcher {
+	return Matcher{
+		Path:        path,
+		Placeholder: "<any number>",
+		Match: func(value interface{}) bool {
+			_, ok := value.(float64)
+			return ok
+		},
+	}
+}
+
+// parsedMatcher is a Matcher with its path parsed.
+type parsedMatcher struct {
+	Matcher
+	path jsonPath
+}
+
+func parseMatchers(matchers []Matcher) ([]parsedMatcher, error) {
+	parsed := make([]parsedMatcher, 0, len(matchers))
+	for _, matcher := range matchers {
+		path, err := parsePath(matcher.Path)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, parsedMatcher{Matcher: matcher, path: path})
+	}
+	return parsed, nil
+}
+
+// applyMatchers returns the placeholder of the first matcher that matches value at
+// path, or value itself if none matches.
+func applyMatchers(matchers []parsedMatcher, path jsonPath, value interface{}) interface{} {
+	for _, matcher := range matchers {
+		if matcher.path.matches(path) && (matcher.Match == nil || matcher.Match(value)) {
+			return matcher.Placeholder
+		}
+	}
+	return value
+}
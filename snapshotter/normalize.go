@@ -0,0 +1,51 @@
+package snapshotter
+
+import (
+	"sort"
+)
+
+// normalize prepares snapshot values for storage and comparison: values
+// matched by Matchers are replaced with placeholders, and arrays at
+// UnorderedPaths are sorted so that their order doesn't matter.
+func (s *Snapshotter) normalize(values []interface{}) ([]interface{}, error) {
+	matchers, err := parseMatchers(s.Matchers)
+	if err != nil {
+		return nil, err
+	}
+	unorderedPaths, err := parsePaths(s.UnorderedPaths)
+	if err != nil {
+		return nil, err
+	}
+	if len(matchers) == 0 && len(unorderedPaths) == 0 {
+		return values, nil
+	}
+
+	return transformValues(values, func(path jsonPath, value interface{}) interface{} {
+		value = applyMatchers(matchers, path, value)
+		if array, ok := value.([]interface{}); ok && path.matchesAny(unorderedPaths) {
+			return sortedByJSON(array)
+		}
+		return value
+	}), nil
+}
+
+// sortedByJSON returns the elements of array sorted by their JSON encoding.
+func sortedByJSON(array []interface{}) []interface{} {
+	encoded := make([]string, len(array))
+	for i, element := range array {
+		encoded[i] = formatJSONValue(element)
+	}
+	indices := make([]int, len(array))
+	for i := range indices {
+		indices[i] = i
+	}
+	sort.SliceStable(indices, func(i, j int) bool {
+		return encoded[indices[i]] < encoded[indices[j]]
+	})
+
+	sorted := make([]interface{}, len(array))
+	for i, index := range indices {
+		sorted[i] = array[index]
+	}
+	return sorted
+}
@@ -0,0 +1,256 @@
+package snapshotter
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// M is the interface of *testing.M used by Main.
+type M interface {
+	Run() int
+}
+
+// Main runs the tests of a package and reports snapshot files in testdata, and
+// in the other snapshot directories used by its tests, that no test used,
+// which are usually left behind when a test is renamed or deleted. When
+// rewriting snapshots, the obsolete snapshot files and their snapshot
+// directories are deleted instead. Other files and directories, such as test
+// fixtures, are never deleted. Call it from TestMain:
+//
+//	func TestMain(m *testing.M) {
+//		os.Exit(snapshotter.Main(m))
+//	}
+//
+// Obsolete snapshots are only detected when all tests ran and passed, so
+// running a subset of tests with -run never reports or deletes snapshots.
+// Snapshots of tests that are skipped look obsolete, so they are only
+// reported, never deleted, when running with -short or when a test that
+// created a Snapshotter was skipped. Tests that skip before creating a
+// Snapshotter can't be detected, so only rewrite snapshots where all tests
+// run. Snapshot directories outside of the package directory, which may be
+// shared with other packages, are never cleaned up.
+func Main(m M) int {
+	usedFiles.enable()
+	code := m.Run()
+	if code != 0 || !ranAllTests() {
+		return code
+	}
+
+	mode, err := GlobalSnapshotMode()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	dirs, used := usedFiles.snapshot()
+	skipped := isShort() || usedFiles.anySkipped()
+	for _, dir := range dirs {
+		if err := cleanUpObsolete(os.Stderr, dir, used, mode, skipped); err != nil {
+			fmt.Fprintf(os.Stderr, "error cleaning up obsolete snapshots: %s\n", err)
+			return 1
+		}
+	}
+	return code
+}
+
+// ranAllTests reports whether the test binary ran all tests, rather than only
+// listing them or running those matching a pattern.
+func ranAllTests() bool {
+	for _, name := range []string{"test.run", "test.skip", "test.list"} {
+		if f := flag.Lookup(name); f != nil && f.Value.String() != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// isShort reports whether the tests run with -short, which usually skips
+// some of them.
+func isShort() bool {
+	f := flag.Lookup("test.short")
+	return f != nil && f.Value.String() == "true"
+}
+
+// usedFiles holds the snapshot files used by the tests run by Main.
+var usedFiles = &fileTracker{}
+
+// fileTracker records the snapshot files used by a test binary, and the
+// snapshot directories holding them.
+type fileTracker struct {
+	mu      sync.Mutex
+	enabled bool
+	dirs    map[string]bool
+	files   map[string]bool
+	skipped bool
+}
+
+func (t *fileTracker) enable() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.enabled = true
+	t.skipped = false
+	t.dirs = map[string]bool{defaultSnapshotDir: true}
+	t.files = make(map[string]bool)
+}
+
+// use records that the snapshot file name in the snapshot directory dir was
+// used.
+func (t *fileTracker) use(dir, name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.enabled {
+		if isInPackage(dir) {
+			t.dirs[filepath.Clean(dir)] = true
+		}
+		t.files[filepath.Clean(name)] = true
+	}
+}
+
+// skip records that a test using the snapshot file name in the snapshot
+// directory dir was skipped. Its snapshot file counts as used.
+func (t *fileTracker) skip(dir, name string) {
+	t.use(dir, name)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.skipped = t.enabled
+}
+
+// anySkipped reports whether a test using a snapshot file was skipped.
+func (t *fileTracker) anySkipped() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.skipped
+}
+
+// snapshot returns the snapshot directories inside the package directory, in
+// order, and the snapshot files used so far.
+func (t *fileTracker) snapshot() ([]string, map[string]bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	dirs := make([]string, 0, len(t.dirs))
+	for dir := range t.dirs {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	files := make(map[string]bool, len(t.files))
+	for name := range t.files {
+		files[name] = true
+	}
+	return dirs, files
+}
+
+// findObsolete returns the snapshot files in dir that don't belong to one of
+// the used snapshot files, and the snapshot directories of those snapshot
+// files. Only directories that belong to a snapshot file, or that hold a used
+// snapshot file, are searched, and other directories are never considered
+// obsolete, so that other test data is never mistaken for snapshots.
+func findObsolete(dir string, used map[string]bool) ([]string, error) {
+	var obsolete []string
+	if err := findObsoleteIn(dir, used, &obsolete); err != nil {
+		return nil, err
+	}
+	sort.Strings(obsolete)
+	return obsolete, nil
+}
+
+// findObsoleteIn appends the obsolete snapshots in dir to obsolete.
+func findObsoleteIn(dir string, used map[string]bool, obsolete *[]string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// usedStems and obsoleteStems hold the snapshot directories of the used
+	// and obsolete snapshot files in dir.
+	usedStems := make(map[string]bool)
+	obsoleteStems := make(map[string]bool)
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		stem, ok := snapshotFileStem(path)
+		if entry.IsDir() || !ok {
+			continue
+		}
+		// Pending snapshot files belong to their snapshot file.
+		if used[strings.TrimSuffix(path, pendingSuffix)] {
+			usedStems[stem] = true
+		} else {
+			*obsolete = append(*obsolete, path)
+			obsoleteStems[stem] = true
+		}
+	}
+
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if !entry.IsDir() {
+			continue
+		}
+		// Snapshot directories hold the snapshot files of subtests with
+		// NestedFileName, so they are only obsolete if none of those is used.
+		holdsUsed := holdsUsedFile(path, used)
+		switch {
+		case obsoleteStems[path] && !usedStems[path] && !holdsUsed:
+			*obsolete = append(*obsolete, path)
+		case obsoleteStems[path] || usedStems[path] || holdsUsed:
+			if err := findObsoleteIn(path, used, obsolete); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// holdsUsedFile reports whether one of the used snapshot files is inside the
+// directory dir.
+func holdsUsedFile(dir string, used map[string]bool) bool {
+	prefix := filepath.Clean(dir) + string(filepath.Separator)
+	for name := range used {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// snapshotFileStem returns the path of a snapshot file without its
+// ".snapshots.<extension>" suffix, which is also the path of its snapshot
+// directory, and whether path is a snapshot file at all.
+func snapshotFileStem(path string) (string, bool) {
+	i := strings.LastIndex(path, ".snapshots.")
+	if i < 0 || strings.ContainsRune(path[i+len(".snapshots."):], filepath.Separator) {
+		return "", false
+	}
+	return path[:i], true
+}
+
+// cleanUpObsolete reports the obsolete snapshots in dir to w, and deletes them
+// when rewriting snapshots unless tests were skipped.
+func cleanUpObsolete(w io.Writer, dir string, used map[string]bool, mode SnapshotMode, skipped bool) error {
+	obsolete, err := findObsolete(dir, used)
+	if err != nil {
+		return err
+	}
+	rewrite := mode == SnapshotModeRewrite || mode == SnapshotModeCheckAndRewrite
+	for _, path := range obsolete {
+		if !rewrite {
+			fmt.Fprintf(w, "obsolete snapshot %s is not used by any test. You can run `go test . -rewriteSnapshots` to delete it.\n", path)
+			continue
+		}
+		if skipped {
+			fmt.Fprintf(w, "obsolete snapshot %s is not used by any test, but was kept because tests were skipped. Run all tests with `go test . -rewriteSnapshots` to delete it.\n", path)
+			continue
+		}
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "deleted obsolete snapshot %s\n", path)
+	}
+	return nil
+}
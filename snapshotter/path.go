@@ -0,0 +1,195 @@
+package snapshotter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// pathSegment is a segment of a JSON path: an object key, an array index, or a
+// wildcard matching any key or index.
+type pathSegment struct {
+	key      string
+	index    int
+	isIndex  bool
+	wildcard bool
+}
+
+func keySegment(key string) pathSegment {
+	return pathSegment{key: key}
+}
+
+func indexSegment(index int) pathSegment {
+	return pathSegment{index: index, isIndex: true}
+}
+
+// jsonPath is a parsed JSON path such as "$.Values[0].Items[*].Name". Paths are
+// rooted at the snapshot as stored in the snapshot file, so the values passed
+// to Snapshot are at "$.Values[0]", "$.Values[1]", and so on.
+type jsonPath []pathSegment
+
+// parsePath parses a JSON path. It supports object keys written as ".key" or
+// `["key"]`, array indices written as "[0]", and wildcards written as ".*" or
+// "[*]".
+func parsePath(path string) (jsonPath, error) {
+	if !strings.HasPrefix(path, "$") {
+		return nil, fmt.Errorf("invalid path %q: must start with $", path)
+	}
+	var parsed jsonPath
+	rest := path[1:]
+	for rest != "" {
+		switch {
+		case strings.HasPrefix(rest, "."):
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			key := rest[:end]
+			if key == "" {
+				return nil, fmt.Errorf("invalid path %q: empty key", path)
+			}
+			if key == "*" {
+				parsed = append(parsed, pathSegment{wildcard: true})
+			} else {
+				parsed = append(parsed, keySegment(key))
+			}
+			rest = rest[end:]
+		case strings.HasPrefix(rest, "[\""):
+			end := strings.Index(rest, "\"]")
+			if end < 0 {
+				return nil, fmt.Errorf("invalid path %q: unterminated key", path)
+			}
+			key, err := strconv.Unquote(rest[1 : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid path %q: %s", path, err)
+			}
+			parsed = append(parsed, keySegment(key))
+			rest = rest[end+2:]
+		case strings.HasPrefix(rest, "["):
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("invalid path %q: unterminated index", path)
+			}
+			if rest[1:end] == "*" {
+				parsed = append(parsed, pathSegment{wildcard: true})
+			} else {
+				index, err := strconv.Atoi(rest[1:end])
+				if err != nil {
+					return nil, fmt.Errorf("invalid path %q: invalid index %q", path, rest[1:end])
+				}
+				parsed = append(parsed, indexSegment(index))
+			}
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("invalid path %q: unexpected %q", path, rest)
+		}
+	}
+	return parsed, nil
+}
+
+// parsePaths parses a list of JSON paths.
+func parsePaths(paths []string) ([]jsonPath, error) {
+	parsed := make([]jsonPath, 0, len(paths))
+	for _, path := range paths {
+		p, err := parsePath(path)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, p)
+	}
+	return parsed, nil
+}
+
+// matches reports whether the concrete path matches p.
+func (p jsonPath) matches(path jsonPath) bool {
+	if len(p) != len(path) {
+		return false
+	}
+	for i, segment := range p {
+		if segment.wildcard {
+			continue
+		}
+		if segment != path[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// wildcards returns the number of wildcards in p.
+func (p jsonPath) wildcards() int {
+	n := 0
+	for _, segment := range p {
+		if segment.wildcard {
+			n++
+		}
+	}
+	return n
+}
+
+// matchesAny reports whether the concrete path matches any of patterns.
+func (p jsonPath) matchesAny(patterns []jsonPath) bool {
+	for _, pattern := range patterns {
+		if pattern.matches(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// String formats a path, e.g. `$.Values[0]["a key"]`.
+func (p jsonPath) String() string {
+	var b strings.Builder
+	b.WriteString("$")
+	for _, segment := range p {
+		switch {
+		case segment.wildcard:
+			b.WriteString("[*]")
+		case segment.isIndex:
+			fmt.Fprintf(&b, "[%d]", segment.index)
+		default:
+			b.WriteString(formatKey(segment.key))
+		}
+	}
+	return b.String()
+}
+
+// child returns a copy of p extended with segment.
+func (p jsonPath) child(segment pathSegment) jsonPath {
+	child := make(jsonPath, len(p)+1)
+	copy(child, p)
+	child[len(p)] = segment
+	return child
+}
+
+// transformJSON walks a JSON value depth-first and replaces every value with
+// the result of calling fn with its path. Children are transformed before
+// their parents.
+func transformJSON(value interface{}, path jsonPath, fn func(path jsonPath, value interface{}) interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		transformed := make(map[string]interface{}, len(v))
+		for key, child := range v {
+			transformed[key] = transformJSON(child, path.child(keySegment(key)), fn)
+		}
+		value = transformed
+	case []interface{}:
+		transformed := make([]interface{}, len(v))
+		for i, child := range v {
+			transformed[i] = transformJSON(child, path.child(indexSegment(i)), fn)
+		}
+		value = transformed
+	}
+	return fn(path, value)
+}
+
+// transformValues transforms each of a snapshot's values with transformJSON.
+func transformValues(values []interface{}, fn func(path jsonPath, value interface{}) interface{}) []interface{} {
+	transformed := make([]interface{}, len(values))
+	root := jsonPath{keySegment("Values")}
+	for i, value := range values {
+		transformed[i] = transformJSON(value, root.child(indexSegment(i)), fn)
+	}
+	return transformed
+}
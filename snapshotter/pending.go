@@ -0,0 +1,507 @@
+package snapshotter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// pendingSuffix is appended to the names of the files of pending snapshots.
+const pendingSuffix = ".new"
+
+// writePending writes the snapshots that differ from the snapshot file name to
+// pending files next to the snapshot file and its sidecar files, so that they
+// can be reviewed and accepted with cmd/snapshotter instead of rewriting all
+// snapshots. It reports whether the pending files were written. s.mu must be
+// held.
+func (s *Snapshotter) writePending(name string) bool {
+	s.t.Helper()
+	if len(s.snapshots) == 0 {
+		return false
+	}
+	if err := s.removePending(name); err != nil {
+		s.t.Errorf("error removing pending snapshots: %s", err)
+		return false
+	}
+	stored, err := s.writeSidecarFiles(true)
+	if err != nil {
+		s.t.Errorf("error writing pending snapshot files: %s", err)
+		return false
+	}
+	return s.writeSnapshotFile(name+pendingSuffix, stored)
+}
+
+// acceptHint returns a sentence explaining how to accept the pending snapshots
+// of the snapshot file name, if they were written.
+func acceptHint(name string, pending bool) string {
+	if !pending {
+		return ""
+	}
+	return fmt.Sprintf(" The new snapshots were written to %s, and you can review and accept them with `snapshotter diff %s` and `snapshotter accept %s`, using github.com/samsarahq/go/snapshotter/cmd/snapshotter.", name+pendingSuffix, name, name)
+}
+
+// removePending removes the pending files of the snapshot file name.
+func (s *Snapshotter) removePending(name string) error {
+	files, err := sidecarFiles(name+pendingSuffix, s.serializer())
+	if err != nil {
+		return err
+	}
+	return removePendingFiles(s.snapshotDir(), append([]string{name}, files...))
+}
+
+// removePendingFiles removes the pending versions of files, which belong to
+// the snapshot file with the stem and start with the snapshot file. The
+// snapshot file is removed last, so that an interrupted removal leaves a
+// pending change behind.
+func removePendingFiles(stem string, files []string) error {
+	for i := len(files) - 1; i >= 0; i-- {
+		if err := os.Remove(files[i] + pendingSuffix); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return removeEmptyDirs(filepath.Join(stem, binaryFileDir), stem)
+}
+
+// PendingChange is a snapshot file with new snapshots that were written by
+// Verify when they differed from the snapshot file, and have not been
+// accepted or rejected yet. The whole snapshot file can be accepted or
+// rejected, or its snapshots one by one.
+type PendingChange struct {
+	// SnapshotFile is the path of the snapshot file.
+	SnapshotFile string
+}
+
+// FindPendingChanges returns the pending changes of the snapshot files in dir
+// and its subdirectories, ordered by snapshot file.
+func FindPendingChanges(dir string) ([]*PendingChange, error) {
+	var changes []*PendingChange
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(path, pendingSuffix) {
+			return nil
+		}
+		if name := strings.TrimSuffix(path, pendingSuffix); isSnapshotFile(name) {
+			changes = append(changes, &PendingChange{SnapshotFile: name})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// PendingChangeOf returns the pending change of the snapshot file name, which
+// may also be the name of its pending file.
+func PendingChangeOf(name string) (*PendingChange, error) {
+	name = strings.TrimSuffix(name, pendingSuffix)
+	if !isSnapshotFile(name) {
+		return nil, fmt.Errorf("%s is not a snapshot file", name)
+	}
+	if _, err := os.Stat(name + pendingSuffix); err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%s has no pending changes", name)
+		}
+		return nil, err
+	}
+	return &PendingChange{SnapshotFile: name}, nil
+}
+
+// isSnapshotFile reports whether name is the name of a snapshot file.
+func isSnapshotFile(name string) bool {
+	_, ok := snapshotFileStem(name)
+	return ok
+}
+
+// serializer returns the Serializer of the snapshot file of the change.
+func (c *PendingChange) serializer() (Serializer, error) {
+	serializer, ok := serializers[strings.TrimPrefix(filepath.Ext(c.SnapshotFile), ".")]
+	if !ok {
+		return nil, fmt.Errorf("%s is not stored with a built-in serializer", c.SnapshotFile)
+	}
+	return serializer, nil
+}
+
+// files returns the pending files of the change, starting with the pending
+// snapshot file followed by the pending sidecar files listed in it, without
+// pendingSuffix.
+func (c *PendingChange) files() ([]string, error) {
+	serializer, err := c.serializer()
+	if err != nil {
+		return nil, err
+	}
+	listed, err := sidecarFiles(c.SnapshotFile+pendingSuffix, serializer)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(listed)
+	files := []string{c.SnapshotFile}
+	for _, name := range listed {
+		// The pending files of snapshots that were accepted on their own
+		// have already replaced the current files.
+		if _, err := os.Stat(name + pendingSuffix); err == nil {
+			files = append(files, name)
+		}
+	}
+	return files, nil
+}
+
+// Diff returns the differences between the snapshot file and its sidecar
+// files and their pending versions.
+func (c *PendingChange) Diff() (string, error) {
+	files, err := c.files()
+	if err != nil {
+		return "", err
+	}
+	var diff strings.Builder
+	for _, name := range files {
+		current, err := ioutil.ReadFile(name)
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		pending, err := ioutil.ReadFile(name + pendingSuffix)
+		if err != nil {
+			return "", err
+		}
+		switch {
+		case bytes.Equal(current, pending):
+		case isText(current) && isText(pending):
+			fmt.Fprintf(&diff, "%s:\n%s", name, diffString(string(current), string(pending)))
+		default:
+			fmt.Fprintf(&diff, "%s: expected %d bytes, got %d bytes\n", name, len(current), len(pending))
+		}
+	}
+	return diff.String(), nil
+}
+
+// Accept replaces the snapshot file and its sidecar files with their pending
+// versions, like rewriting the snapshots would have done. It accepts every
+// snapshot of the file, not just the ones that differ.
+func (c *PendingChange) Accept() error {
+	files, err := c.files()
+	if err != nil {
+		return err
+	}
+	serializer, err := c.serializer()
+	if err != nil {
+		return err
+	}
+	current, err := sidecarFiles(c.SnapshotFile, serializer)
+	if err != nil {
+		return err
+	}
+	// Files of snapshots that were accepted on their own are listed in the
+	// pending snapshot file, but have no pending version anymore.
+	accepted, err := sidecarFiles(c.SnapshotFile+pendingSuffix, serializer)
+	if err != nil {
+		return err
+	}
+	// Rename the snapshot file last, so that an interrupted Accept leaves a
+	// pending change behind.
+	for i := len(files) - 1; i >= 0; i-- {
+		if err := os.Rename(files[i]+pendingSuffix, files[i]); err != nil {
+			return err
+		}
+	}
+	stem, _ := snapshotFileStem(c.SnapshotFile)
+	return removeSidecarFiles(stem, current, accepted)
+}
+
+// Reject removes the pending versions of the snapshot file and its sidecar
+// files, leaving every snapshot of the file as it was.
+func (c *PendingChange) Reject() error {
+	files, err := c.files()
+	if err != nil {
+		return err
+	}
+	stem, _ := snapshotFileStem(c.SnapshotFile)
+	return removePendingFiles(stem, files)
+}
+
+// removeEmptyDirs removes the directories dirs, in order, if they exist and
+// are empty.
+func removeEmptyDirs(dirs ...string) error {
+	for _, dir := range dirs {
+		entries, err := ioutil.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			if err := os.Remove(dir); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// snapshotFiles reads the current and the pending snapshots of the change.
+func (c *PendingChange) snapshotFiles() (current, pending []*Snapshot, err error) {
+	serializer, err := c.serializer()
+	if err != nil {
+		return nil, nil, err
+	}
+	read := func(name string) ([]*Snapshot, error) {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		snapshots, err := serializer.Unmarshal(data)
+		if err != nil {
+			return nil, fmt.Errorf("error unmarshaling %s: %s", name, err)
+		}
+		return snapshots, nil
+	}
+	if current, err = read(c.SnapshotFile); err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	if pending, err = read(c.SnapshotFile + pendingSuffix); err != nil {
+		return nil, nil, err
+	}
+	return current, pending, nil
+}
+
+// Snapshots returns the names of the snapshots that differ between the
+// snapshot file and its pending version, in the order of the pending
+// snapshots followed by the removed snapshots.
+func (c *PendingChange) Snapshots() ([]string, error) {
+	current, pending, err := c.snapshotFiles()
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Dir(c.SnapshotFile)
+	currentGroups, pendingGroups := groupSnapshots(current), groupSnapshots(pending)
+	var names []string
+	for _, name := range snapshotNames(pending, current) {
+		currentKey, err := groupKey(dir, currentGroups[name], false)
+		if err != nil {
+			return nil, err
+		}
+		pendingKey, err := groupKey(dir, pendingGroups[name], true)
+		if err != nil {
+			return nil, err
+		}
+		if currentKey != pendingKey {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// AcceptSnapshots accepts the pending versions of the snapshots with the
+// names, including the files they are stored in, and keeps the other
+// snapshots pending. Snapshots sharing a name are accepted together. The
+// change is resolved once no snapshots differ anymore.
+func (c *PendingChange) AcceptSnapshots(names ...string) error {
+	current, pending, err := c.snapshotFiles()
+	if err != nil {
+		return err
+	}
+	accepted, err := c.checkNames(names, current, pending)
+	if err != nil {
+		return err
+	}
+	merged, err := mergeSnapshots(pending, current, func(name string) bool { return !accepted[name] })
+	if err != nil {
+		return err
+	}
+	serializer, err := c.serializer()
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(c.SnapshotFile)
+	stem, _ := snapshotFileStem(c.SnapshotFile)
+
+	for _, file := range storedFiles(dir, stem, snapshotsNamed(pending, accepted)) {
+		if err := os.Rename(file+pendingSuffix, file); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if len(merged) == 0 {
+		if err := os.Remove(c.SnapshotFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	} else {
+		data, err := serializer.Marshal(merged)
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomically(c.SnapshotFile, data, 0644); err != nil {
+			return err
+		}
+	}
+	if err := removeSidecarFiles(stem, storedFiles(dir, stem, current), storedFiles(dir, stem, merged)); err != nil {
+		return err
+	}
+	return c.resolveIfUnchanged()
+}
+
+// RejectSnapshots rejects the pending versions of the snapshots with the
+// names, keeping them as they are in the snapshot file, and keeps the other
+// snapshots pending. Snapshots sharing a name are rejected together. The
+// change is resolved once no snapshots differ anymore.
+func (c *PendingChange) RejectSnapshots(names ...string) error {
+	current, pending, err := c.snapshotFiles()
+	if err != nil {
+		return err
+	}
+	rejected, err := c.checkNames(names, current, pending)
+	if err != nil {
+		return err
+	}
+	merged, err := mergeSnapshots(pending, current, func(name string) bool { return rejected[name] })
+	if err != nil {
+		return err
+	}
+	serializer, err := c.serializer()
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(c.SnapshotFile)
+	stem, _ := snapshotFileStem(c.SnapshotFile)
+
+	data, err := serializer.Marshal(merged)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomically(c.SnapshotFile+pendingSuffix, data, 0644); err != nil {
+		return err
+	}
+	for _, file := range storedFiles(dir, stem, snapshotsNamed(pending, rejected)) {
+		if err := os.Remove(file + pendingSuffix); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return c.resolveIfUnchanged()
+}
+
+// checkNames returns the set of names, which must be names of snapshots in
+// the current or pending snapshots.
+func (c *PendingChange) checkNames(names []string, current, pending []*Snapshot) (map[string]bool, error) {
+	known := make(map[string]bool)
+	for _, name := range snapshotNames(current, pending) {
+		known[name] = true
+	}
+	set := make(map[string]bool, len(names))
+	for _, name := range names {
+		if !known[name] {
+			return nil, fmt.Errorf("%s has no snapshot named %q", c.SnapshotFile, name)
+		}
+		set[name] = true
+	}
+	return set, nil
+}
+
+// resolveIfUnchanged removes the pending files of the change if none of its
+// snapshots differ anymore.
+func (c *PendingChange) resolveIfUnchanged() error {
+	names, err := c.Snapshots()
+	if err != nil || len(names) > 0 {
+		return err
+	}
+	return c.Reject()
+}
+
+// snapshotNames returns the distinct names of the snapshots in first, in
+// order, followed by the names of the snapshots in second that are not in
+// first.
+func snapshotNames(first, second []*Snapshot) []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, snapshots := range [][]*Snapshot{first, second} {
+		for _, snapshot := range snapshots {
+			if !seen[snapshot.Name] {
+				seen[snapshot.Name] = true
+				names = append(names, snapshot.Name)
+			}
+		}
+	}
+	return names
+}
+
+// groupSnapshots groups snapshots by name, keeping snapshots sharing a name
+// in order.
+func groupSnapshots(snapshots []*Snapshot) map[string][]*Snapshot {
+	groups := make(map[string][]*Snapshot)
+	for _, snapshot := range snapshots {
+		groups[snapshot.Name] = append(groups[snapshot.Name], snapshot)
+	}
+	return groups
+}
+
+// acceptedSnapshots returns the snapshots whose names are in names.
+func snapshotsNamed(snapshots []*Snapshot, names map[string]bool) []*Snapshot {
+	var accepted []*Snapshot
+	for _, snapshot := range snapshots {
+		if names[snapshot.Name] {
+			accepted = append(accepted, snapshot)
+		}
+	}
+	return accepted
+}
+
+// mergeSnapshots returns the pending snapshots, in order, with the snapshots
+// whose names other reports replaced by the current snapshots of that name,
+// which are dropped if there are none. Current snapshots that are not pending
+// are kept at the end if other reports their name. Snapshots that would be
+// stored in the same file can't be merged.
+func mergeSnapshots(pending, current []*Snapshot, other func(name string) bool) ([]*Snapshot, error) {
+	pendingGroups, currentGroups := groupSnapshots(pending), groupSnapshots(current)
+	var merged []*Snapshot
+	for _, name := range snapshotNames(pending, current) {
+		if other(name) {
+			merged = append(merged, currentGroups[name]...)
+		} else {
+			merged = append(merged, pendingGroups[name]...)
+		}
+	}
+
+	files := make(map[string]string)
+	for _, snapshot := range merged {
+		if snapshot.File == "" {
+			continue
+		}
+		if name, ok := files[snapshot.File]; ok && name != snapshot.Name {
+			return nil, fmt.Errorf("snapshots %s and %s would be stored in the same file %s. Accept or reject the whole snapshot file instead.", name, snapshot.Name, snapshot.File)
+		}
+		files[snapshot.File] = snapshot.Name
+	}
+	return merged, nil
+}
+
+// groupKey returns a string that is equal for equal groups of snapshots
+// stored in a snapshot file in dir, including the contents of the files they
+// are stored in, which are read from their pending versions if pending is
+// set and they exist.
+func groupKey(dir string, group []*Snapshot, pending bool) (string, error) {
+	var key strings.Builder
+	for _, snapshot := range group {
+		values, err := json.Marshal(snapshot.Values)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&key, "%t %q %s\n", snapshot.Binary, snapshot.File, values)
+		if snapshot.File == "" {
+			continue
+		}
+		path := filepath.Join(dir, filepath.FromSlash(snapshot.File))
+		data, err := ioutil.ReadFile(path + pendingSuffix)
+		if !pending || os.IsNotExist(err) {
+			data, err = ioutil.ReadFile(path)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		fmt.Fprintf(&key, "%q\n", data)
+	}
+	return key.String(), nil
+}
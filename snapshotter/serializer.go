@@ -0,0 +1,302 @@
+package snapshotter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/kylelemons/godebug/pretty"
+	"gopkg.in/yaml.v3"
+)
+
+// Serializer stores snapshots in snapshot files. A Serializer encodes each
+// value passed to Snapshot into the value that is compared, and marshals and
+// unmarshals the snapshots of a snapshot file.
+//
+// Options that refer to JSON paths, such as UnorderedPaths and Matchers, apply
+// to the values as encoded by the Serializer.
+type Serializer interface {
+	// Extension returns the extension of snapshot files, without a leading
+	// dot, such as "json".
+	Extension() string
+	// Encode encodes a value passed to Snapshot.
+	Encode(value interface{}) (interface{}, error)
+	// Marshal marshals the snapshots of a snapshot file.
+	Marshal(snapshots []*Snapshot) ([]byte, error)
+	// Unmarshal unmarshals the snapshots of a snapshot file. The values of the
+	// unmarshaled snapshots must equal the encoded values that were marshaled.
+	Unmarshal(data []byte) ([]*Snapshot, error)
+}
+
+var (
+	// SerializerJSON stores snapshots as JSON. Values are compared as they
+	// are marshaled by encoding/json. It is the default Serializer.
+	SerializerJSON Serializer = jsonSerializer{}
+	// SerializerYAML stores snapshots as YAML. Values are compared as they
+	// are marshaled by encoding/json, like for SerializerJSON.
+	SerializerYAML Serializer = yamlSerializer{}
+	// SerializerGoSyntax stores snapshots as values pretty-printed in Go
+	// syntax, which keeps large integers exact, byte slices as bytes and map
+	// keys as they are. Values are compared as their pretty-printed text.
+	SerializerGoSyntax Serializer = goSyntaxSerializer{}
+)
+
+type jsonSerializer struct{}
+
+func (jsonSerializer) Extension() string {
+	return "json"
+}
+
+func (jsonSerializer) Encode(value interface{}) (interface{}, error) {
+	return jsonRoundTrip(value)
+}
+
+func (jsonSerializer) Marshal(snapshots []*Snapshot) ([]byte, error) {
+	return marshalJSON(snapshots, "  ")
+}
+
+func (jsonSerializer) Unmarshal(data []byte) ([]*Snapshot, error) {
+	var snapshots []*Snapshot
+	if err := json.Unmarshal(data, &snapshots); err != nil {
+		return nil, err
+	}
+	return snapshots, nil
+}
+
+type yamlSerializer struct{}
+
+func (yamlSerializer) Extension() string {
+	return "yaml"
+}
+
+func (yamlSerializer) Encode(value interface{}) (interface{}, error) {
+	return jsonRoundTrip(value)
+}
+
+// yamlSnapshot is a snapshot as stored in a YAML snapshot file.
+type yamlSnapshot struct {
+	Name   string        `yaml:"name"`
+	Values []interface{} `yaml:"values"`
+	File   string        `yaml:"file,omitempty"`
+	Binary bool          `yaml:"binary,omitempty"`
+}
+
+func (yamlSerializer) Marshal(snapshots []*Snapshot) ([]byte, error) {
+	stored := make([]yamlSnapshot, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		stored = append(stored, yamlSnapshot{Name: snapshot.Name, Values: snapshot.Values, File: snapshot.File, Binary: snapshot.Binary})
+	}
+	var buffer bytes.Buffer
+	encoder := yaml.NewEncoder(&buffer)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(stored); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (yamlSerializer) Unmarshal(data []byte) ([]*Snapshot, error) {
+	var stored []yamlSnapshot
+	if err := yaml.Unmarshal(data, &stored); err != nil {
+		return nil, err
+	}
+	snapshots := make([]*Snapshot, 0, len(stored))
+	for _, snapshot := range stored {
+		values := make([]interface{}, 0, len(snapshot.Values))
+		for _, value := range snapshot.Values {
+			converted, err := fromYAML(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", snapshot.Name, err)
+			}
+			values = append(values, converted)
+		}
+		snapshots = append(snapshots, &Snapshot{Name: snapshot.Name, Values: values, File: snapshot.File, Binary: snapshot.Binary})
+	}
+	return snapshots, nil
+}
+
+// fromYAML converts a value unmarshaled from YAML to the value encoding/json
+// would have unmarshaled, so that it can be compared with encoded values.
+func fromYAML(value interface{}) (interface{}, error) {
+	switch value := value.(type) {
+	case nil, bool, string, float64:
+		return value, nil
+	case int:
+		return float64(value), nil
+	case int64:
+		return float64(value), nil
+	case uint64:
+		return float64(value), nil
+	case []interface{}:
+		converted := make([]interface{}, 0, len(value))
+		for _, element := range value {
+			element, err := fromYAML(element)
+			if err != nil {
+				return nil, err
+			}
+			converted = append(converted, element)
+		}
+		return converted, nil
+	case map[string]interface{}:
+		converted := make(map[string]interface{}, len(value))
+		for key, element := range value {
+			element, err := fromYAML(element)
+			if err != nil {
+				return nil, err
+			}
+			converted[key] = element
+		}
+		return converted, nil
+	default:
+		return nil, fmt.Errorf("unsupported YAML value %v of type %T", value, value)
+	}
+}
+
+type goSyntaxSerializer struct{}
+
+// goSyntaxConfig pretty-prints values in Go syntax across multiple lines, so
+// they can be compared with a line diff.
+var goSyntaxConfig = &pretty.Config{Diffable: true}
+
+const (
+	// goSyntaxNamePrefix starts a snapshot in a Go syntax snapshot file.
+	goSyntaxNamePrefix = "=== "
+	// goSyntaxSeparator separates the values of a snapshot in a Go syntax
+	// snapshot file. Pretty-printed values never contain a line like it.
+	goSyntaxSeparator = "---"
+	// goSyntaxFilePrefix and goSyntaxBinary follow the name of a snapshot
+	// stored in a separate file. Pretty-printed values never start with "@".
+	goSyntaxFilePrefix = "@file "
+	goSyntaxBinary     = "@binary"
+)
+
+func (goSyntaxSerializer) Extension() string {
+	return "txt"
+}
+
+func (goSyntaxSerializer) Encode(value interface{}) (interface{}, error) {
+	return goSyntaxConfig.Sprint(value), nil
+}
+
+// Marshal writes each snapshot as a line with its name, followed by its
+// values separated by lines with goSyntaxSeparator, or by the file it is
+// stored in:
+//
+//	=== name
+//	{Foo: "Bar"}
+//	---
+//	1
+//	=== export
+//	@file TestName/files/export.csv
+//	@binary
+func (goSyntaxSerializer) Marshal(snapshots []*Snapshot) ([]byte, error) {
+	var buffer bytes.Buffer
+	for _, snapshot := range snapshots {
+		if strings.Contains(snapshot.Name, "\n") {
+			return nil, fmt.Errorf("snapshot name %q contains a newline", snapshot.Name)
+		}
+		fmt.Fprintf(&buffer, "%s%s\n", goSyntaxNamePrefix, snapshot.Name)
+		if snapshot.File != "" {
+			fmt.Fprintf(&buffer, "%s%s\n", goSyntaxFilePrefix, snapshot.File)
+		}
+		if snapshot.Binary {
+			fmt.Fprintln(&buffer, goSyntaxBinary)
+		}
+		for i, value := range snapshot.Values {
+			text, ok := value.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s: value %v is not encoded", snapshot.Name, value)
+			}
+			if i > 0 {
+				fmt.Fprintln(&buffer, goSyntaxSeparator)
+			}
+			fmt.Fprintln(&buffer, text)
+		}
+	}
+	return buffer.Bytes(), nil
+}
+
+func (goSyntaxSerializer) Unmarshal(data []byte) ([]*Snapshot, error) {
+	var snapshots []*Snapshot
+	var lines []string
+	finishValue := func() {
+		if len(lines) > 0 {
+			last := snapshots[len(snapshots)-1]
+			last.Values = append(last.Values, strings.Join(lines, "\n"))
+			lines = nil
+		}
+	}
+
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		switch {
+		case strings.HasPrefix(line, goSyntaxNamePrefix):
+			finishValue()
+			snapshots = append(snapshots, &Snapshot{Name: strings.TrimPrefix(line, goSyntaxNamePrefix)})
+		case len(snapshots) == 0 && line == "":
+			continue
+		case len(snapshots) == 0:
+			return nil, fmt.Errorf("expected a line starting with %q, got %q", goSyntaxNamePrefix, line)
+		case line == goSyntaxSeparator:
+			finishValue()
+		case strings.HasPrefix(line, goSyntaxFilePrefix):
+			snapshots[len(snapshots)-1].File = strings.TrimPrefix(line, goSyntaxFilePrefix)
+		case line == goSyntaxBinary:
+			snapshots[len(snapshots)-1].Binary = true
+		default:
+			lines = append(lines, line)
+		}
+	}
+	finishValue()
+	return snapshots, nil
+}
+
+// hasJSONStructure reports whether serializer encodes values as JSON values,
+// rather than as opaque text like SerializerGoSyntax. Custom serializers are
+// assumed to encode JSON values.
+func hasJSONStructure(serializer Serializer) bool {
+	switch serializer := serializer.(type) {
+	case goSyntaxSerializer:
+		return false
+	case typedSerializer:
+		return hasJSONStructure(serializer.Serializer)
+	}
+	return true
+}
+
+// checkPathOptions returns an error if options that refer to values inside
+// snapshots are set, but the serializer of s stores values as opaque text, so
+// the options would be silently ignored.
+func (s *Snapshotter) checkPathOptions() error {
+	if hasJSONStructure(s.serializer()) {
+		return nil
+	}
+	var options []string
+	if len(s.UnorderedPaths) > 0 {
+		options = append(options, "UnorderedPaths")
+	}
+	if len(s.Matchers) > 0 {
+		options = append(options, "Matchers")
+	}
+	if s.FloatTolerance != (FloatTolerance{}) {
+		options = append(options, "FloatTolerance")
+	}
+	if len(s.PathFloatTolerances) > 0 {
+		options = append(options, "PathFloatTolerances")
+	}
+	if len(options) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%s cannot be used with a serializer that stores values as text, such as SerializerGoSyntax. Use SerializerJSON or SerializerYAML instead.", strings.Join(options, ", "))
+}
+
+// serializer returns the Serializer used by s.
+func (s *Snapshotter) serializer() Serializer {
+	if s.Serializer == nil {
+		return SerializerJSON
+	}
+	return s.Serializer
+}
@@ -0,0 +1,258 @@
+package snapshotter
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// textFileExtension is the extension of files holding string snapshots.
+	textFileExtension = ".txt"
+	// binaryFileDir is the directory in the snapshot directory holding the
+	// files of byte snapshots.
+	binaryFileDir = "files"
+	// binaryFileExtension is the extension of files of byte snapshots taken
+	// with SnapshotBytes.
+	binaryFileExtension = ".bin"
+)
+
+// SnapshotBytes records data, such as generated protobuf bytes, for a snapshot
+// test. The data is stored in a file in the snapshot directory, and compared
+// byte for byte. Differing data is reported with a diff of hex dumps, or a
+// line diff if TextByteDiff is set and the data is text.
+func (s *Snapshotter) SnapshotBytes(name string, data []byte) {
+	s.snapshotBytes(name, data, binaryFileExtension)
+}
+
+// SnapshotFile records the contents of the file at path, such as a CSV export
+// or a gzip file, for a snapshot test, like SnapshotBytes. The stored file
+// keeps the extension of path.
+func (s *Snapshotter) SnapshotFile(name string, path string) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		s.t.Errorf("%s: error reading file: %s", name, err)
+		return
+	}
+	s.snapshotBytes(name, data, filepath.Ext(path))
+}
+
+func (s *Snapshotter) snapshotBytes(name string, data []byte, extension string) {
+	s.add(&Snapshot{
+		Name:      name,
+		Binary:    true,
+		data:      append([]byte{}, data...),
+		extension: extension,
+	})
+}
+
+// snapshotDir returns the directory holding the files that belong to the
+// snapshot file, such as images and text files.
+func (s *Snapshotter) snapshotDir() string {
+	return strings.TrimSuffix(s.SnapshotFileName(), ".snapshots."+s.serializer().Extension())
+}
+
+// isTextSnapshot reports whether snapshot is stored in a text file when
+// TextFiles is set.
+func (s *Snapshotter) isTextSnapshot(snapshot *Snapshot) bool {
+	if !s.TextFiles || len(snapshot.Values) != 1 {
+		return false
+	}
+	// Go syntax snapshot files already store values as text.
+	if _, ok := s.serializer().(goSyntaxSerializer); ok {
+		return false
+	}
+	text, ok := snapshot.Values[0].(string)
+	return ok && strings.Contains(text, "\n")
+}
+
+// writeSidecarFiles writes the snapshots that are stored in separate files,
+// and returns the snapshots to store in the snapshot file. Files are named
+// after their snapshot, and referenced by their path relative to the snapshot
+// file. Pending files are written with pendingSuffix appended to their name.
+func (s *Snapshotter) writeSidecarFiles(pending bool) ([]*Snapshot, error) {
+	dir := s.snapshotDir()
+	suffix := ""
+	if pending {
+		suffix = pendingSuffix
+	}
+
+	stored := make([]*Snapshot, 0, len(s.snapshots))
+	keys := snapshotKeys(s.snapshots)
+	// usedPaths holds the lower-cased paths of the files written so far.
+	// Distinct snapshot names can sanitize to the same file name, such as
+	// "a b" and "a_b", and file systems may ignore case, so files that would
+	// overwrite one another get a numbered suffix.
+	usedPaths := make(map[string]bool)
+	for i, snapshot := range s.snapshots {
+		name := sanitizeForPath(snapshot.Name)
+		if keys[i].occurrence > 0 {
+			name = fmt.Sprintf("%s_%d", name, keys[i].occurrence+1)
+		}
+
+		var fileDir, extension string
+		var data []byte
+		switch {
+		case snapshot.Binary:
+			fileDir, extension = filepath.Join(dir, binaryFileDir), snapshot.extension
+			data = snapshot.data
+		case s.isTextSnapshot(snapshot):
+			fileDir, extension = dir, textFileExtension
+			data = []byte(snapshot.Values[0].(string))
+		default:
+			stored = append(stored, snapshot)
+			continue
+		}
+		path := filepath.Join(fileDir, name+extension)
+		for n := 2; usedPaths[strings.ToLower(path)]; n++ {
+			path = filepath.Join(fileDir, fmt.Sprintf("%s_%d%s", name, n, extension))
+		}
+		usedPaths[strings.ToLower(path)] = true
+
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, err
+		}
+		if err := writeFileAtomically(path+suffix, data, 0644); err != nil {
+			return nil, err
+		}
+		file, err := filepath.Rel(filepath.Dir(s.SnapshotFileName()), path)
+		if err != nil {
+			return nil, err
+		}
+		stored = append(stored, &Snapshot{Name: snapshot.Name, File: filepath.ToSlash(file), Binary: snapshot.Binary})
+	}
+	return stored, nil
+}
+
+// sidecarFiles returns the paths of the files holding the values of the
+// snapshots in the snapshot file name, which is stored with serializer. A
+// snapshot file that does not exist or doesn't parse has no files, and files
+// outside of the directory of the snapshot file are ignored, so that a broken
+// snapshot file can't make the caller remove other files.
+func sidecarFiles(name string, serializer Serializer) ([]string, error) {
+	data, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	snapshots, err := serializer.Unmarshal(data)
+	if err != nil {
+		return nil, nil
+	}
+	stem, _ := snapshotFileStem(strings.TrimSuffix(name, pendingSuffix))
+	return storedFiles(filepath.Dir(name), stem, snapshots), nil
+}
+
+// storedFiles returns the paths of the files of the snapshots stored in a
+// snapshot file in dir, which are inside the directory stem.
+func storedFiles(dir, stem string, stored []*Snapshot) []string {
+	var files []string
+	for _, snapshot := range stored {
+		if snapshot == nil || snapshot.File == "" {
+			continue
+		}
+		path := filepath.Join(dir, filepath.FromSlash(snapshot.File))
+		if strings.HasPrefix(path, filepath.Clean(stem)+string(filepath.Separator)) {
+			files = append(files, path)
+		}
+	}
+	return files
+}
+
+// removeSidecarFiles removes the files that are not in keep, and then the
+// directories holding the files of the snapshot file with the stem, if they
+// are empty. Other files in those directories, such as the snapshot files of
+// subtests stored with NestedFileName, are kept.
+func removeSidecarFiles(stem string, files, keep []string) error {
+	kept := make(map[string]bool, len(keep))
+	for _, file := range keep {
+		kept[file] = true
+	}
+	for _, file := range files {
+		if kept[file] {
+			continue
+		}
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return removeEmptyDirs(filepath.Join(stem, binaryFileDir), stem)
+}
+
+// readSidecarFiles reads the values of snapshots stored in separate files.
+func (s *Snapshotter) readSidecarFiles(snapshots []*Snapshot) error {
+	for _, snapshot := range snapshots {
+		if snapshot.File == "" {
+			continue
+		}
+		path := filepath.Join(filepath.Dir(s.SnapshotFileName()), filepath.FromSlash(snapshot.File))
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("%s: %s", snapshot.Name, err)
+		}
+		if snapshot.Binary {
+			snapshot.data = data
+		} else {
+			snapshot.Values = []interface{}{string(data)}
+		}
+		snapshot.File = ""
+	}
+	return nil
+}
+
+// diffBytes returns the difference between an expected and an actual
+// snapshot, at least one of which is a byte snapshot, or an empty string if
+// they are equal.
+func (s *Snapshotter) diffBytes(expected, actual *Snapshot) string {
+	switch {
+	case !expected.Binary:
+		return "expected values, got bytes\n"
+	case !actual.Binary:
+		return "expected bytes, got values\n"
+	case bytes.Equal(expected.data, actual.data):
+		return ""
+	}
+
+	summary := fmt.Sprintf("expected %d bytes, got %d bytes\n", len(expected.data), len(actual.data))
+	if s.TextByteDiff && isText(expected.data) && isText(actual.data) {
+		return summary + diffString(string(expected.data), string(actual.data))
+	}
+	return summary + diffString(hex.Dump(expected.data), hex.Dump(actual.data))
+}
+
+// isText reports whether data looks like text rather than binary data.
+func isText(data []byte) bool {
+	return utf8.Valid(data) && !bytes.ContainsRune(data, 0)
+}
+
+// removeFilesExcept removes the files with the extension from dir, except the
+// files with the extension except, unless it is empty, and removes dir if it
+// is empty afterwards.
+func removeFilesExcept(dir, extension, except string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	remaining := len(entries)
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), extension) || (except != "" && strings.HasSuffix(entry.Name(), except)) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+		remaining--
+	}
+	if remaining == 0 {
+		return os.Remove(dir)
+	}
+	return nil
+}
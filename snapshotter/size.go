@@ -0,0 +1,157 @@
+package snapshotter
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// SizeLimit limits the size of snapshots, in bytes as they are stored, so that
+// snapshots of accidentally large values don't bloat the repository.
+type SizeLimit struct {
+	// Snapshot is the maximum size of each snapshot, including the file
+	// holding its value if it is stored in a separate file. Zero means no
+	// limit.
+	Snapshot int
+	// File is the maximum size of all snapshots of the snapshot file
+	// together. Zero means no limit.
+	File int
+	// Warn logs snapshots exceeding the limits instead of failing the test,
+	// and still stores them.
+	Warn bool
+}
+
+// logger is implemented by a T that can log, such as *testing.T.
+type logger interface {
+	Logf(format string, args ...interface{})
+}
+
+// checkSizes reports snapshots exceeding the SizeLimit of s, and reports
+// whether they may be stored and compared anyway. s.mu must be held.
+func (s *Snapshotter) checkSizes() bool {
+	s.t.Helper()
+	limit := s.SizeLimit
+	if limit.Snapshot == 0 && limit.File == 0 {
+		return true
+	}
+
+	var messages []string
+	sizes := make([]int, len(s.snapshots))
+	total := 0
+	for i, snapshot := range s.snapshots {
+		size, err := s.snapshotSize(snapshot)
+		if err != nil {
+			s.t.Errorf("%s: error measuring snapshot: %s", snapshot.Name, err)
+			return false
+		}
+		sizes[i] = size
+		total += size
+		if limit.Snapshot > 0 && size > limit.Snapshot {
+			messages = append(messages, fmt.Sprintf("snapshot %s is %d bytes, more than the limit of %d bytes. %s", snapshot.Name, size, limit.Snapshot, shrinkHint(snapshot)))
+		}
+	}
+	if limit.File > 0 && total > limit.File {
+		messages = append(messages, fmt.Sprintf("snapshots in %s are %d bytes, more than the limit of %d bytes. The largest snapshots are %s.", s.SnapshotFileName(), total, limit.File, largestSnapshots(s.snapshots, sizes, 3)))
+	}
+
+	for _, message := range messages {
+		if !limit.Warn {
+			s.t.Errorf("%s", message)
+		} else if t, ok := s.t.(logger); ok {
+			t.Logf("warning: %s", message)
+		} else {
+			fmt.Fprintf(os.Stderr, "warning: %s\n", message)
+		}
+	}
+	return len(messages) == 0 || limit.Warn
+}
+
+// snapshotSize returns the number of bytes snapshot takes up when it is
+// stored.
+func (s *Snapshotter) snapshotSize(snapshot *Snapshot) (int, error) {
+	switch {
+	case snapshot.Binary:
+		return len(snapshot.data), nil
+	case s.isTextSnapshot(snapshot):
+		return len(snapshot.Values[0].(string)), nil
+	}
+	data, err := s.serializer().Marshal([]*Snapshot{snapshot})
+	if err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// shrinkHint suggests how to make snapshot smaller, pointing at the field that
+// makes up most of its size if there is one.
+func shrinkHint(snapshot *Snapshot) string {
+	if path, ok := largestField(snapshot.Values); ok {
+		return fmt.Sprintf("Snapshot only the values the test is about, or ignore large fields with Matchers such as snapshotter.Ignore(%q).", path)
+	}
+	return "Snapshot only the values the test is about, or ignore large fields with Matchers such as snapshotter.Ignore."
+}
+
+// largestField returns the path of the innermost field that makes up most of
+// the size of values, if there is one below the values themselves.
+func largestField(values []interface{}) (jsonPath, bool) {
+	path, value, size := largestChild(jsonPath{keySegment("Values")}, values)
+	for {
+		childPath, child, childSize := largestChild(path, value)
+		if childPath == nil || childSize*2 < size {
+			break
+		}
+		path, value, size = childPath, child, childSize
+	}
+	return path, len(path) > 2
+}
+
+// largestChild returns the path, value and JSON size of the largest element or
+// field of value, which is at path, or a nil path if value has none.
+func largestChild(path jsonPath, value interface{}) (jsonPath, interface{}, int) {
+	var largestPath jsonPath
+	var largest interface{}
+	largestSize := -1
+	consider := func(segment pathSegment, child interface{}) {
+		data, err := json.Marshal(child)
+		if err == nil && len(data) > largestSize {
+			largestPath, largest, largestSize = path.child(segment), child, len(data)
+		}
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			consider(keySegment(key), v[key])
+		}
+	case []interface{}:
+		for i, child := range v {
+			consider(indexSegment(i), child)
+		}
+	}
+	return largestPath, largest, largestSize
+}
+
+// largestSnapshots formats the names and sizes of the n largest snapshots.
+func largestSnapshots(snapshots []*Snapshot, sizes []int, n int) string {
+	order := make([]int, len(snapshots))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return sizes[order[i]] > sizes[order[j]]
+	})
+	if len(order) > n {
+		order = order[:n]
+	}
+	largest := make([]string, len(order))
+	for i, index := range order {
+		largest[i] = fmt.Sprintf("%s (%d bytes)", snapshots[index].Name, sizes[index])
+	}
+	return strings.Join(largest, ", ")
+}
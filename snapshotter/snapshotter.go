@@ -1,15 +1,18 @@
 package snapshotter
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"flag"
+	"fmt"
 	"image"
-	"image/png"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
+	"sync"
 	"unicode"
 
 	"github.com/kylelemons/godebug/pretty"
@@ -25,6 +28,8 @@ type T interface {
 
 var rewriteFlag = flag.Bool("rewriteSnapshots", false, "Rewrite test data output. Should not be used with -rewriteWithFailOnDiff")
 var rewriteWithFailOnDiff = flag.Bool("rewriteWithFailOnDiff", false, "Rewrites the snapshot while still failing the test on diff. Should not be used with -rewriteSnapshots")
+var writeNewFlag = flag.Bool("writeNewSnapshots", false, "Write snapshot files that don't exist yet, without rewriting existing snapshot files")
+var ciFlag = flag.Bool("snapshotsCI", false, "Check snapshots without ever writing them, and report snapshots that were never committed")
 
 func isRewrite() bool {
 	rewriteEnvVar := os.Getenv("REWRITE_SNAPSHOTS") == "1"
@@ -36,6 +41,16 @@ func isRewriteWithFailOnDiff() bool {
 	return rewriteEnvVar || *rewriteWithFailOnDiff
 }
 
+func isWriteNew() bool {
+	writeNewEnvVar := os.Getenv("WRITE_NEW_SNAPSHOTS") == "1"
+	return writeNewEnvVar || *writeNewFlag
+}
+
+func isCI() bool {
+	ciEnvVar := os.Getenv("SNAPSHOTS_CI") == "1"
+	return ciEnvVar || *ciFlag
+}
+
 type SnapshotMode int
 
 type RenderFn func(values []interface{}) (image.Image, error)
@@ -51,6 +66,13 @@ const (
 	// SnapshotModeCheckAndRewrite means a snapshot diff will fail the test, and
 	// the snapshot will be updated.
 	SnapshotModeCheckAndRewrite
+	// SnapshotModeWriteNew means snapshots that don't exist yet will be
+	// written, and existing snapshots will be checked but never updated.
+	SnapshotModeWriteNew
+	// SnapshotModeCI means snapshots will be checked like SnapshotModeCheck, and
+	// snapshots that were never committed are reported as such rather than as
+	// differing.
+	SnapshotModeCI
 )
 
 // GlobalSnapshotMode returns the snapshot mode configured in global state
@@ -60,6 +82,21 @@ func GlobalSnapshotMode() (SnapshotMode, error) {
 		return SnapshotModeUndefined, errors.New("choose one of rewriteWithFailOnDiff and rewriteSnapshots, otherwise unexpected behavior can occur.")
 	}
 
+	if isWriteNew() && (isRewrite() || isRewriteWithFailOnDiff()) {
+		return SnapshotModeUndefined, errors.New("writeNewSnapshots never rewrites existing snapshots and should not be used with rewriteSnapshots or rewriteWithFailOnDiff.")
+	}
+
+	if isCI() {
+		if isRewrite() || isRewriteWithFailOnDiff() || isWriteNew() {
+			return SnapshotModeUndefined, errors.New("snapshots are never written in CI, so snapshotsCI should not be used with rewriteSnapshots, rewriteWithFailOnDiff or writeNewSnapshots.")
+		}
+		return SnapshotModeCI, nil
+	}
+
+	if isWriteNew() {
+		return SnapshotModeWriteNew, nil
+	}
+
 	if isRewrite() {
 		return SnapshotModeRewrite, nil
 	}
@@ -93,105 +130,283 @@ func jsonRoundTrip(value interface{}) (interface{}, error) {
 	return roundtripped, nil
 }
 
-type snapshot struct {
+// marshalJSON marshals value like json.MarshalIndent, without escaping HTML
+// characters such as "<" so that snapshot files stay readable.
+func marshalJSON(value interface{}, indent string) ([]byte, error) {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", indent)
+	if err := encoder.Encode(value); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buffer.Bytes(), []byte("\n")), nil
+}
+
+// Snapshot is a snapshot as stored in a snapshot file.
+type Snapshot struct {
 	Name   string
 	Values []interface{}
+	// File is the path of the file holding the value of the snapshot,
+	// relative to the snapshot file, if it is stored in a separate file.
+	File string `json:",omitempty"`
+	// Binary is set for snapshots taken with SnapshotBytes or SnapshotFile.
+	Binary bool `json:",omitempty"`
+
+	// data and extension are the data of a byte snapshot, and the extension
+	// of the file it is stored in.
+	data      []byte
+	extension string
+	// prefix is the name prefix of the child Snapshotter that took the
+	// snapshot.
+	prefix string
 }
 
 // Snapshotter is a utility for writing snapshot tests. In a snapshot, the
 // expected test output is generated by running the test and storing the
 // output, which for complex test outputs would otherwise require a lot of
 // effort to write.
+//
+// Snapshot may be called from multiple goroutines, such as parallel subtests.
+// Each Snapshotter must use its own snapshot file, and the configuration of a
+// Snapshotter must not change after it took its first snapshot.
 type Snapshotter struct {
-	t              T
-	name           string
-	snapshots      []*snapshot
+	t    T
+	name string
+	// parent is the Snapshotter storing the snapshots of a child Snapshotter,
+	// which prefixes the names of its snapshots with prefix.
+	parent *Snapshotter
+	prefix string
+
+	// mu guards snapshots, whether they were verified and the claim of the
+	// snapshot file.
+	mu        sync.Mutex
+	snapshots []*Snapshot
+	verified  bool
+	claimed   string
+	conflict  bool
+
 	SnapshotErrors bool
+	// SnapshotDir is the directory holding the snapshot files, relative to
+	// the package directory. It defaults to "testdata".
+	SnapshotDir string
+	// FileName names the snapshot files in SnapshotDir. It defaults to
+	// FlatFileName.
+	FileName FileNameFunc
+	// Serializer selects the format of the snapshot file. It defaults to
+	// SerializerJSON.
+	Serializer Serializer
+	// TextFiles stores snapshots of a single multi-line string, such as
+	// rendered SQL or HTML, in separate text files next to the snapshot file,
+	// so they can be reviewed as plain text.
+	TextFiles bool
+	// TextByteDiff reports differing byte snapshots that are text, such as CSV
+	// exports, with a line diff instead of a diff of hex dumps.
+	TextByteDiff bool
+	// DiffFormat selects how Verify reports differing snapshot values. It
+	// defaults to a line diff.
+	DiffFormat DiffFormat
+	// IgnoreOrder makes Verify match snapshots by name regardless of the order
+	// in which they were taken. Snapshots sharing a name are matched by value.
+	IgnoreOrder bool
+	// UnorderedPaths are JSON paths of arrays whose elements are compared as
+	// sets, regardless of their order, such as "$.Values[0].Items" or
+	// "$.Values[*].Items[*].Tags". See Snapshot for how paths are rooted.
+	UnorderedPaths []string
+	// Matchers replace volatile values, such as timestamps and generated IDs,
+	// with placeholders before snapshots are stored and compared. Only the
+	// placeholders are stored, so values are checked against these Matchers.
+	Matchers []Matcher
+	// FloatTolerance is how much numbers may differ from the expected numbers
+	// when comparing snapshots.
+	FloatTolerance FloatTolerance
+	// PathFloatTolerances overrides FloatTolerance for the numbers at the
+	// given JSON paths. If several paths match a number, the path with the
+	// fewest wildcards applies.
+	PathFloatTolerances map[string]FloatTolerance
+	// SizeLimit limits the size of snapshots. Verify fails the test, without
+	// storing or comparing the snapshots, if they exceed it.
+	SizeLimit SizeLimit
+	// ImageComparison selects the metric VerifyWithImage uses to compare
+	// rendered images against stored images.
+	ImageComparison ImageComparison
+	// ImageTolerance configures how VerifyWithImage compares rendered images
+	// against stored images. The zero value requires an exact match.
+	ImageTolerance ImageTolerance
 }
 
 // New creates a new Snapshotter. Any errors encountered will fail
-// the test.
+// the test. If t is a CleanupT, snapshots that are never verified fail the
+// test when it finishes.
 func New(t T) *Snapshotter {
-	return &Snapshotter{t: t}
+	s := &Snapshotter{t: t}
+	s.checkVerified()
+	return s
 }
 
 func NewNamed(t T, name string) *Snapshotter {
-	return &Snapshotter{t: t, name: name}
+	s := &Snapshotter{t: t, name: name}
+	s.checkVerified()
+	return s
 }
 
 // Snapshot records a value for a snapshot test. For the test to pass, all
 // invocations to Snapshot should have the same arguments. All values should be
-// JSON-marshalable.
+// JSON-marshalable, or otherwise encodable by the Serializer.
+//
+// Options that refer to JSON paths, such as UnorderedPaths, are rooted at the
+// snapshot as stored in the snapshot file: the values passed to Snapshot are
+// at "$.Values[0]", "$.Values[1]", and so on.
 func (s *Snapshotter) Snapshot(name string, values ...interface{}) {
+	root := s.root()
 	for i, value := range values {
-		roundtripped, err := jsonRoundTrip(value)
+		encoded, err := root.serializer().Encode(value)
 		if err != nil {
-			s.t.Errorf("%s: error roundtripping value %v: %s", name, value, err)
+			s.t.Errorf("%s: error encoding value %v: %s", name, value, err)
 			return
 		}
-		values[i] = roundtripped
+		values[i] = encoded
+	}
+	values, err := root.normalize(values)
+	if err != nil {
+		s.t.Errorf("%s: %s", name, err)
+		return
 	}
 
-	s.snapshots = append(s.snapshots, &snapshot{
+	s.add(&Snapshot{
 		Name:   name,
 		Values: values,
 	})
 }
 
+// add records a snapshot, in the parent of a child Snapshotter.
+func (s *Snapshotter) add(snapshot *Snapshot) {
+	s.t.Helper()
+	snapshot.Name = s.prefix + snapshot.Name
+	snapshot.prefix = s.prefix
+
+	root := s.root()
+	root.mu.Lock()
+	defer root.mu.Unlock()
+	if root.claimForTest() {
+		root.snapshots = append(root.snapshots, snapshot)
+		root.verified = false
+	}
+}
+
 func (s *Snapshotter) rewrite(name string) {
+	if err := s.removePending(name); err != nil {
+		s.t.Errorf("error removing pending snapshots: %s", err)
+		return
+	}
+	previous, err := sidecarFiles(name, s.serializer())
+	if err != nil {
+		s.t.Errorf("error reading snapshot files: %s", err)
+		return
+	}
+	stored, err := s.writeSidecarFiles(false)
+	if err != nil {
+		s.t.Errorf("error writing snapshot files: %s", err)
+		return
+	}
+
 	// If there are no snapshots, then when rewriting, we want to remove the file if it exists.
 	if len(s.snapshots) == 0 {
-		if _, err := os.Stat(name); os.IsNotExist(err) {
-			return
-		}
-
-		// The file exists, so let's remove it.
-		if err := os.Remove(name); err != nil {
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
 			s.t.Errorf("failed to remove the existing snapshot file %s", name)
+			return
 		}
+	} else if !s.writeSnapshotFile(name, stored) {
 		return
 	}
-	if err := os.MkdirAll("testdata", 0755); err != nil {
-		s.t.Errorf("error creating testdata directory: %s", err)
-		return
+
+	// Only the files of the previous snapshots are removed, because the
+	// directory of the snapshot file may hold other files, such as the
+	// snapshot files of subtests.
+	dir := s.snapshotDir()
+	if err := removeSidecarFiles(dir, previous, storedFiles(filepath.Dir(name), dir, stored)); err != nil {
+		s.t.Errorf("error removing snapshot files: %s", err)
 	}
-	bytes, err := json.MarshalIndent(s.snapshots, "", "  ")
+}
+
+// writeSnapshotFile writes the snapshots stored to the snapshot file name.
+func (s *Snapshotter) writeSnapshotFile(name string, stored []*Snapshot) bool {
+	s.t.Helper()
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		s.t.Errorf("error creating snapshot directory: %s", err)
+		return false
+	}
+	bytes, err := s.serializer().Marshal(stored)
 	if err != nil {
 		s.t.Errorf("error marshaling snapshots: %s", err)
-		return
+		return false
 	}
-	if err := ioutil.WriteFile(name, bytes, 0644); err != nil {
+	if err := writeFileAtomically(name, bytes, 0644); err != nil {
 		s.t.Errorf("error writing snapshots: %s", err)
-		return
+		return false
 	}
+	return true
 }
 
 // Returns the name of the snapshot file that will/would be created when running Verify.
-// Includes the testdata/ path
+// Includes the snapshot directory, such as testdata/.
 func (s *Snapshotter) SnapshotFileName() string {
 	s.t.Helper()
-	nameSuffix := ""
-	if s.name != "" {
-		nameSuffix = "_" + sanitizeForPath(s.name)
+	if s.parent != nil {
+		return s.parent.SnapshotFileName()
 	}
-	return filepath.Join("testdata", sanitizeForPath(s.t.Name())+nameSuffix+".snapshots.json")
+	return filepath.Join(s.snapshotRoot(), s.fileName()(s.t.Name(), s.name)+".snapshots."+s.serializer().Extension())
 }
 
 // Verify finishes a snapshot test. It either compares the test output, or it
-// rewrites the test output.
+// rewrites the test output. Verify does nothing for child Snapshotters, which
+// are verified by their parent.
 func (s *Snapshotter) Verify() {
 	s.t.Helper()
+	if s.parent != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.claim() {
+		return
+	}
+	defer s.release()
+	s.verify()
+}
+
+// verify implements Verify. s.mu must be held.
+func (s *Snapshotter) verify() {
+	s.t.Helper()
+	s.verified = true
+	s.sortChildSnapshots()
 	mode, err := GlobalSnapshotMode()
 	if err != nil {
 		s.t.Error(err)
 		return
 	}
 	name := s.SnapshotFileName()
-	if mode == SnapshotModeRewrite {
+	usedFiles.use(s.snapshotRoot(), name)
+	if err := s.checkPathOptions(); err != nil {
+		s.t.Error(err)
+		return
+	}
+	if !s.checkSizes() {
+		return
+	}
+	_, err = os.Stat(name)
+	exists := !os.IsNotExist(err)
+	if mode == SnapshotModeRewrite || (mode == SnapshotModeWriteNew && !exists) {
 		s.rewrite(name)
 	} else {
 		// When no snapshots file exists and no snapshots have been taken, do nothing.
-		if _, err := os.Stat(name); os.IsNotExist(err) && len(s.snapshots) == 0 {
+		if !exists && len(s.snapshots) == 0 {
+			return
+		}
+
+		if !exists {
+			pending := mode != SnapshotModeCI && s.writePending(name)
+			s.reportNewFile(mode, name, pending)
 			return
 		}
 
@@ -200,74 +415,277 @@ func (s *Snapshotter) Verify() {
 			s.t.Errorf("error reading snapshots: %s", err)
 			return
 		}
-		var expected []*snapshot
-		if err := json.Unmarshal(bytes, &expected); err != nil {
+		expected, err := s.serializer().Unmarshal(bytes)
+		if err != nil {
 			s.t.Errorf("error unmarshaling snapshots: %s", err)
 			return
 		}
+		if err := s.readSidecarFiles(expected); err != nil {
+			s.t.Errorf("error reading snapshot files: %s", err)
+			return
+		}
+
+		for _, snapshot := range expected {
+			if snapshot.Values, err = s.normalize(snapshot.Values); err != nil {
+				s.t.Errorf("%s: %s", snapshot.Name, err)
+				return
+			}
+		}
 
 		if mode == SnapshotModeCheckAndRewrite {
 			s.rewrite(name)
 		}
 
-		actual := s.snapshots
+		if s.compare(mode, expected, s.snapshots) {
+			pending := (mode == SnapshotModeCheck || mode == SnapshotModeWriteNew) && s.writePending(name)
+			s.t.Errorf("If this is intentional, you can run `go test . -rewriteSnapshots` to generate new snapshots.%s", acceptHint(name, pending))
+		} else if mode != SnapshotModeCI {
+			if err := s.removePending(name); err != nil {
+				s.t.Errorf("error removing pending snapshots: %s", err)
+			}
+		}
+	}
+}
+
+// reportNewFile fails the test for snapshots that were taken without a
+// snapshot file to compare them with, and whose pending snapshots may have
+// been written.
+func (s *Snapshotter) reportNewFile(mode SnapshotMode, name string, pending bool) {
+	s.t.Helper()
+	if mode == SnapshotModeCI {
+		s.t.Errorf("snapshot file %s was never committed. Run `go test . -rewriteSnapshots` locally and commit it.", name)
+		return
+	}
+	s.t.Errorf("snapshot file %s does not exist. If this is a new test, you can run `go test . -writeNewSnapshots` to generate new snapshots.%s", name, acceptHint(name, pending))
+}
+
+// snapshotKey identifies a snapshot by its name and, for snapshots sharing a
+// name, the order in which it was taken.
+type snapshotKey struct {
+	name       string
+	occurrence int
+}
+
+func (k snapshotKey) String() string {
+	if k.occurrence == 0 {
+		return k.name
+	}
+	return fmt.Sprintf("%s (#%d)", k.name, k.occurrence+1)
+}
+
+// snapshotKeys returns the key of each snapshot.
+func snapshotKeys(snapshots []*Snapshot) []snapshotKey {
+	occurrences := make(map[string]int)
+	keys := make([]snapshotKey, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		keys = append(keys, snapshotKey{name: snapshot.Name, occurrence: occurrences[snapshot.Name]})
+		occurrences[snapshot.Name]++
+	}
+	return keys
+}
+
+// compare aligns the expected and actual snapshots by name, reports the
+// difference of every snapshot that differs, and finishes with a summary of
+// all differing, missing and extra snapshots. It reports whether the snapshots
+// differ.
+func (s *Snapshotter) compare(mode SnapshotMode, expected, actual []*Snapshot) bool {
+	s.t.Helper()
+
+	c, err := s.newComparer()
+	if err != nil {
+		s.t.Errorf("%s", err)
+		return false
+	}
+
+	expectedKeys := snapshotKeys(expected)
+	expectedByKey := make(map[snapshotKey]*Snapshot, len(expected))
+	for i, key := range expectedKeys {
+		expectedByKey[key] = expected[i]
+	}
+
+	actualKeys := snapshotKeys(actual)
+	if s.IgnoreOrder {
+		actualKeys = matchKeysByValue(c, expected, expectedKeys, actual)
+	}
 
-		var actualNames, expectedNames []string
-		for _, snapshot := range actual {
-			actualNames = append(actualNames, snapshot.Name)
+	var differing, missing, extra []string
+	var matchedActual, matchedExpected []snapshotKey
+	matched := make(map[snapshotKey]bool)
+	for i, key := range actualKeys {
+		expectedSnapshot, ok := expectedByKey[key]
+		if !ok {
+			extra = append(extra, key.String())
+			continue
 		}
-		for _, snapshot := range expected {
-			expectedNames = append(expectedNames, snapshot.Name)
+		matched[key] = true
+		matchedActual = append(matchedActual, key)
+		if diff := s.diffSnapshot(c, expectedSnapshot, actual[i]); diff != "" {
+			s.t.Errorf("snapshot %s differs:\n%s", key, diff)
+			differing = append(differing, key.String())
 		}
-
-		if diff := diffString(expectedNames, actualNames); diff != "" {
-			s.t.Errorf("snapshot names differ:\n%s", diff)
-			return
+	}
+	for _, key := range expectedKeys {
+		if !matched[key] {
+			missing = append(missing, key.String())
+			continue
 		}
+		matchedExpected = append(matchedExpected, key)
+	}
+	orderDiffers := !s.IgnoreOrder && !reflect.DeepEqual(matchedExpected, matchedActual)
+
+	if len(differing) == 0 && len(missing) == 0 && len(extra) == 0 && !orderDiffers {
+		return false
+	}
+
+	var summary strings.Builder
+	fmt.Fprintf(&summary, "snapshots in %s differ:", s.SnapshotFileName())
+	if len(differing) > 0 {
+		fmt.Fprintf(&summary, "\n  %d differing: %s", len(differing), strings.Join(differing, ", "))
+	}
+	if len(missing) > 0 {
+		fmt.Fprintf(&summary, "\n  %d missing: %s", len(missing), strings.Join(missing, ", "))
+	}
+	if len(extra) > 0 && mode == SnapshotModeCI {
+		fmt.Fprintf(&summary, "\n  %d never committed: %s", len(extra), strings.Join(extra, ", "))
+	} else if len(extra) > 0 {
+		fmt.Fprintf(&summary, "\n  %d extra: %s", len(extra), strings.Join(extra, ", "))
+	}
+	if orderDiffers {
+		fmt.Fprintf(&summary, "\n  order differs:\n%s", diffString(keyNames(matchedExpected), keyNames(matchedActual)))
+	}
+	s.t.Errorf("%s", summary.String())
+	return true
+}
 
-		for i := range actual {
-			expectedValue := expected[i].Values
-			actualValue := actual[i].Values
-
-			if len(expectedValue) == 1 && len(actualValue) == 1 {
-				if expectedString, ok := expectedValue[0].(string); ok {
-					if actualString, ok := actualValue[0].(string); ok {
-						if diff := diffString(expectedString, actualString); diff != "" {
-							s.t.Errorf("snapshot %s differs:\n%s", actual[i].Name, diff)
-							s.t.Errorf("If this is intentional, you can run `go test . -rewriteSnapshots` to generate new snapshots.")
-							return
-						}
-					}
+// matchKeysByValue returns a key for each actual snapshot such that snapshots
+// sharing a name are matched with an expected snapshot with the same values
+// where possible, regardless of the order in which they were taken.
+func matchKeysByValue(c *comparer, expected []*Snapshot, expectedKeys []snapshotKey, actual []*Snapshot) []snapshotKey {
+	expectedByName := make(map[string][]int)
+	for i, snapshot := range expected {
+		expectedByName[snapshot.Name] = append(expectedByName[snapshot.Name], i)
+	}
+
+	keys := make([]snapshotKey, len(actual))
+	assigned := make([]bool, len(actual))
+	used := make(map[int]bool)
+
+	// First match snapshots with equal values, then pair up the rest in order.
+	for _, equalOnly := range []bool{true, false} {
+		for i, snapshot := range actual {
+			if assigned[i] {
+				continue
+			}
+			for _, j := range expectedByName[snapshot.Name] {
+				if !used[j] && (!equalOnly || c.valuesEqual(expected[j].Values, snapshot.Values)) {
+					keys[i], assigned[i], used[j] = expectedKeys[j], true, true
+					break
 				}
 			}
+		}
+	}
+
+	// Remaining snapshots are extra, and get occurrences past the expected ones.
+	extraOccurrences := make(map[string]int)
+	for i, snapshot := range actual {
+		if !assigned[i] {
+			keys[i] = snapshotKey{
+				name:       snapshot.Name,
+				occurrence: len(expectedByName[snapshot.Name]) + extraOccurrences[snapshot.Name],
+			}
+			extraOccurrences[snapshot.Name]++
+		}
+	}
+	return keys
+}
+
+func keyNames(keys []snapshotKey) []string {
+	names := make([]string, 0, len(keys))
+	for _, key := range keys {
+		names = append(names, key.String())
+	}
+	return names
+}
 
-			if diff := diffString(expected[i].Values, actual[i].Values); diff != "" {
-				s.t.Errorf("snapshot %s differs:\n%s", actual[i].Name, diff)
-				s.t.Errorf("If this is intentional, you can run `go test . -rewriteSnapshots` to generate new snapshots.")
+// diffSnapshot returns the difference between the values of an expected and
+// an actual snapshot, or an empty string if they are equal. Snapshots of a
+// single string, and snapshots stored as Go syntax, are compared with a line
+// diff.
+func (s *Snapshotter) diffSnapshot(c *comparer, expected, actual *Snapshot) string {
+	if expected.Binary || actual.Binary {
+		return s.diffBytes(expected, actual)
+	}
+	if _, ok := s.serializer().(goSyntaxSerializer); ok {
+		expectedText, _ := SerializerGoSyntax.Marshal([]*Snapshot{expected})
+		actualText, _ := SerializerGoSyntax.Marshal([]*Snapshot{actual})
+		if bytes.Equal(expectedText, actualText) {
+			return ""
+		}
+		return diffString(string(expectedText), string(actualText))
+	}
+	if len(expected.Values) == 1 && len(actual.Values) == 1 {
+		if expectedString, ok := expected.Values[0].(string); ok {
+			if actualString, ok := actual.Values[0].(string); ok {
+				return diffString(expectedString, actualString)
 			}
 		}
 	}
+	return diffValues(s.DiffFormat, c, expected.Values, actual.Values)
 }
 
-// VerifyWithImage calls Verify and, when rewriting snapshots, renders PNG
-// images for each snapshot using the provided renderFn. Images are written to a
-// sub-directory derived from the snapshot file name.
+// VerifyWithImage calls Verify and renders PNG images for each snapshot using
+// the provided renderFn. Images are stored in a sub-directory derived from the
+// snapshot file name. When checking snapshots, rendered images are compared
+// against the stored images using ImageTolerance, and a diff image is written
+// next to each image that differs. When rewriting snapshots, the stored images
+// are replaced.
 func (s *Snapshotter) VerifyWithImage(renderFn RenderFn) {
 	s.t.Helper()
-	s.Verify()
+	if s.parent != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.claim() {
+		return
+	}
+	defer s.release()
+
+	_, err := os.Stat(s.SnapshotFileName())
+	isNew := os.IsNotExist(err)
+	s.verify()
 
 	mode, err := GlobalSnapshotMode()
 	if err != nil {
 		return
 	}
+	if mode == SnapshotModeWriteNew {
+		// Images of new snapshot files are written like the snapshot file, and
+		// images of existing snapshot files are only checked.
+		if isNew {
+			mode = SnapshotModeRewrite
+		} else {
+			mode = SnapshotModeCheck
+		}
+	}
+
+	dir := s.snapshotDir()
+	if mode == SnapshotModeCheck || mode == SnapshotModeCheckAndRewrite || mode == SnapshotModeCI {
+		s.verifyImages(dir, renderFn)
+	}
 
 	if mode != SnapshotModeRewrite && mode != SnapshotModeCheckAndRewrite {
 		return
 	}
 
-	dir := strings.TrimSuffix(s.SnapshotFileName(), ".snapshots.json")
-	if err := os.RemoveAll(dir); err != nil {
-		s.t.Errorf("failed to remove image directory %s: %s", dir, err)
+	// Diff images written by the check just now are kept, so that the failure
+	// message doesn't point at a deleted file.
+	keep := ""
+	if mode == SnapshotModeCheckAndRewrite {
+		keep = diffImageExtension
+	}
+	if err := removeFilesExcept(dir, ".png", keep); err != nil {
+		s.t.Errorf("failed to remove images in %s: %s", dir, err)
 		return
 	}
 
@@ -281,6 +699,9 @@ func (s *Snapshotter) VerifyWithImage(renderFn RenderFn) {
 	}
 
 	for _, snap := range s.snapshots {
+		if snap.Binary {
+			continue
+		}
 		sanitizedName := sanitizeForPath(snap.Name)
 		pngPath := filepath.Join(dir, sanitizedName+".png")
 
@@ -290,19 +711,9 @@ func (s *Snapshotter) VerifyWithImage(renderFn RenderFn) {
 			continue
 		}
 
-		f, err := os.Create(pngPath)
-		if err != nil {
-			s.t.Errorf("error creating PNG file %s: %s", pngPath, err)
-			continue
-		}
-
-		if err := png.Encode(f, img); err != nil {
-			f.Close()
-			s.t.Errorf("error encoding PNG for snapshot %s: %s", snap.Name, err)
-			continue
+		if err := writePNG(pngPath, img); err != nil {
+			s.t.Errorf("error writing PNG file %s for snapshot %s: %s", pngPath, snap.Name, err)
 		}
-
-		f.Close()
 	}
 }
 
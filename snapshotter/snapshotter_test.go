@@ -1,13 +1,21 @@
 package snapshotter_test
 
 import (
+	"encoding/json"
+	"flag"
 	"fmt"
 	"image"
 	"image/color"
+	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/samsarahq/go/snapshotter"
 )
@@ -73,11 +81,126 @@ func setRewriteSnapshotsEnv(t *testing.T) {
 	})
 }
 
+// rewriteMockSnapshots writes the snapshots taken by snapshot for a mockT
+// Snapshotter, and then switches back to checking snapshots.
+func rewriteMockSnapshots(t *testing.T, snapshot func(ss *snapshotter.Snapshotter)) {
+	t.Helper()
+	setRewriteSnapshotsEnv(t)
+
+	var m mockT
+	ss := snapshotter.New(&m)
+	snapshot(ss)
+	ss.Verify()
+	if len(m.errors) != 0 {
+		t.Fatalf("unexpected errors rewriting snapshots: %v", m.errors)
+	}
+
+	if err := os.Setenv("REWRITE_SNAPSHOTS", "0"); err != nil {
+		t.Fatalf("failed to reset REWRITE_SNAPSHOTS: %s", err)
+	}
+}
+
+// snapshotStep is a step of a test that takes snapshots with a mockT
+// Snapshotter in the working directory.
+type snapshotStep struct {
+	// env is the environment variable that selects the snapshot mode of the
+	// step, such as "REWRITE_SNAPSHOTS", or "" to check the snapshots.
+	env string
+	// take configures the Snapshotter and takes the snapshots.
+	take func(ss *snapshotter.Snapshotter)
+	// renderFn verifies the snapshots with VerifyWithImage if it is set.
+	renderFn snapshotter.RenderFn
+	// errors are substrings of the errors the step reports, in order.
+	errors []string
+}
+
+// rewriteHint is part of the hint reported after differing snapshots.
+const rewriteHint = "-rewriteSnapshots"
+
+// runSnapshotSteps runs steps in order and checks the errors they report. It
+// returns the errors of the last step.
+func runSnapshotSteps(t *testing.T, steps ...snapshotStep) []string {
+	t.Helper()
+	var errors []string
+	for i, step := range steps {
+		for _, env := range []string{"REWRITE_SNAPSHOTS", "REWRITE_WITH_FAIL_ON_DIFF", "WRITE_NEW_SNAPSHOTS", "SNAPSHOTS_CI"} {
+			value := "0"
+			if env == step.env {
+				value = "1"
+			}
+			t.Setenv(env, value)
+		}
+
+		var m mockT
+		ss := snapshotter.New(&m)
+		step.take(ss)
+		if step.renderFn != nil {
+			ss.VerifyWithImage(step.renderFn)
+		} else {
+			ss.Verify()
+		}
+
+		errors = m.errors
+		if len(m.errors) != len(step.errors) {
+			t.Errorf("step %d: expected errors containing %q, got %q", i, step.errors, m.errors)
+			continue
+		}
+		for j, expected := range step.errors {
+			if !strings.Contains(m.errors[j], expected) {
+				t.Errorf("step %d: expected error containing %q, got %q", i, expected, m.errors[j])
+			}
+		}
+	}
+	return errors
+}
+
+// assertFiles checks that the files in dir, including those in its
+// subdirectories, are exactly expected.
+func assertFiles(t *testing.T, dir string, expected ...string) {
+	t.Helper()
+	var files []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			files = append(files, filepath.ToSlash(path))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = append([]string(nil), expected...)
+	sort.Strings(files)
+	sort.Strings(expected)
+	if strings.Join(files, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected files in %s:\n%s\ngot:\n%s", dir, strings.Join(expected, "\n"), strings.Join(files, "\n"))
+	}
+}
+
 func tinyRenderFn(_ []interface{}) (image.Image, error) {
 	return image.NewRGBA(image.Rect(0, 0, 1, 1)), nil
 }
 
 func TestSnapshotterFailed(t *testing.T) {
+	// Check against a copy of the snapshot file, so that the pending snapshots
+	// are not written next to it.
+	fixture, err := ioutil.ReadFile("testdata/MockTest.snapshots.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	switchToTempWorkingDir(t)
+	if err := os.Mkdir("testdata", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile("testdata/MockTest.snapshots.json", fixture, 0644); err != nil {
+		t.Fatal(err)
+	}
+
 	var m mockT
 	ss := snapshotter.New(&m)
 	ss.Snapshot("good", true)
@@ -89,6 +212,1160 @@ func TestSnapshotterFailed(t *testing.T) {
 	}
 }
 
+func TestVerifyStructuralDiff(t *testing.T) {
+	type item struct {
+		ID   int
+		Name string
+	}
+	type value struct {
+		Foo   string
+		Items []item
+		Extra map[string]interface{} `json:",omitempty"`
+	}
+
+	testCases := []struct {
+		name     string
+		expected interface{}
+		actual   interface{}
+		diff     string
+		// prefix is set if diff is only the start of the difference.
+		prefix bool
+	}{
+		{
+			name:     "changed field",
+			expected: value{Foo: "Bar"},
+			actual:   value{Foo: "Foo"},
+			diff:     "~ $.Values[0].Foo: \"Bar\" -> \"Foo\"\n",
+		},
+		{
+			name:     "added and removed keys",
+			expected: value{Extra: map[string]interface{}{"old": 1, "a key": true}},
+			actual:   value{Extra: map[string]interface{}{"new": 2, "a key": true}},
+			diff:     "+ $.Values[0].Extra.new: 2\n- $.Values[0].Extra.old: 1\n",
+		},
+		{
+			name:     "moved element",
+			expected: value{Items: []item{{1, "a"}, {2, "b"}, {3, "c"}}},
+			actual:   value{Items: []item{{3, "c"}, {1, "a"}, {2, "b"}}},
+			diff:     "> $.Values[0].Items[2]: moved to [0]\n",
+		},
+		{
+			name:     "changed element",
+			expected: value{Items: []item{{1, "a"}, {2, "b"}}},
+			actual:   value{Items: []item{{1, "a"}, {2, "B"}, {4, "d"}}},
+			diff:     "~ $.Values[0].Items[1].Name: \"b\" -> \"B\"\n+ $.Values[0].Items[2]: {\"ID\":4,\"Name\":\"d\"}\n",
+		},
+		{
+			name:     "quoted key",
+			expected: map[string]int{"a key": 1},
+			actual:   map[string]int{"a key": 2},
+			diff:     "~ $.Values[0][\"a key\"]: 1 -> 2\n",
+		},
+		{
+			name:     "changed element of a large array",
+			expected: largeArray(10000, false),
+			actual:   append(append(largeArray(5000, false), -1), largeArray(10000, false)[5001:]...),
+			diff:     "~ $.Values[0][5000]: 5000 -> -1\n",
+		},
+		{
+			// Arrays that differ in too many elements are reported with a
+			// line diff, rather than aligning them.
+			name:     "reordered large array",
+			expected: largeArray(2000, false),
+			actual:   largeArray(2000, true),
+			diff:     "--- expected\n+++ received\n",
+			prefix:   true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			switchToTempWorkingDir(t)
+			rewriteMockSnapshots(t, func(ss *snapshotter.Snapshotter) {
+				ss.Snapshot("value", tc.expected)
+			})
+
+			var m mockT
+			ss := snapshotter.New(&m)
+			ss.DiffFormat = snapshotter.DiffFormatStructural
+			ss.Snapshot("value", tc.actual)
+			ss.Verify()
+			if len(m.errors) == 0 {
+				t.Fatalf("expected snapshot to differ")
+			}
+			expected := "snapshot value differs:\n" + tc.diff
+			if m.errors[0] != expected && !(tc.prefix && strings.HasPrefix(m.errors[0], expected)) {
+				t.Errorf("expected:\n%s\ngot:\n%s", expected, m.errors[0])
+			}
+		})
+	}
+}
+
+// largeArray returns the numbers up to n, in reverse order if reversed is set.
+func largeArray(n int, reversed bool) []int {
+	numbers := make([]int, n)
+	for i := range numbers {
+		numbers[i] = i
+		if reversed {
+			numbers[i] = n - 1 - i
+		}
+	}
+	return numbers
+}
+
+func TestVerifyLineDiff(t *testing.T) {
+	switchToTempWorkingDir(t)
+	rewriteMockSnapshots(t, func(ss *snapshotter.Snapshotter) {
+		ss.Snapshot("value", struct{ Foo string }{Foo: "Bar"})
+	})
+
+	var m mockT
+	ss := snapshotter.New(&m)
+	ss.DiffFormat = snapshotter.DiffFormatLines
+	ss.Snapshot("value", struct{ Foo string }{Foo: "Foo"})
+	ss.Verify()
+	if len(m.errors) == 0 || !strings.Contains(m.errors[0], "-[{Foo: \"Bar\"}]\n+[{Foo: \"Foo\"}]") {
+		t.Errorf("expected line diff, got %v", m.errors)
+	}
+}
+
+func TestVerifyReportsDifferences(t *testing.T) {
+	type snapshot struct {
+		name  string
+		value interface{}
+	}
+	take := func(snapshots []snapshot) func(ss *snapshotter.Snapshotter) {
+		return func(ss *snapshotter.Snapshotter) {
+			for _, snapshot := range snapshots {
+				ss.Snapshot(snapshot.name, snapshot.value)
+			}
+		}
+	}
+
+	testCases := []struct {
+		name   string
+		stored []snapshot
+		actual []snapshot
+		errors []string
+		// orderDiffers is set if the order of the snapshots is reported.
+		orderDiffers bool
+	}{
+		{
+			name:   "all differences",
+			stored: []snapshot{{"a", "first"}, {"b", 2}, {"c", 3}, {"d", 4}, {"dup", 5}, {"dup", 6}},
+			actual: []snapshot{{"a", "changed"}, {"c", 30}, {"dup", 5}, {"e", 5}},
+			errors: []string{
+				"snapshot a differs",
+				"snapshot c differs",
+				"2 differing: a, c\n  3 missing: b, d, dup (#2)\n  1 extra: e",
+				rewriteHint,
+			},
+		},
+		{
+			name:         "order",
+			stored:       []snapshot{{"a", 1}, {"b", 2}},
+			actual:       []snapshot{{"b", 2}, {"a", 1}},
+			errors:       []string{"order differs", rewriteHint},
+			orderDiffers: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			switchToTempWorkingDir(t)
+			errors := runSnapshotSteps(t,
+				snapshotStep{env: "REWRITE_SNAPSHOTS", take: take(tc.stored)},
+				snapshotStep{take: take(tc.actual), errors: tc.errors},
+			)
+			if orderDiffers := strings.Contains(strings.Join(errors, "\n"), "order differs"); orderDiffers != tc.orderDiffers {
+				t.Errorf("expected the order to be reported: %v, got %q", tc.orderDiffers, errors)
+			}
+			assertFiles(t, "testdata", "testdata/MockTest.snapshots.json", "testdata/MockTest.snapshots.json.new")
+		})
+	}
+}
+
+func TestVerifyIgnoreOrder(t *testing.T) {
+	switchToTempWorkingDir(t)
+	rewriteMockSnapshots(t, func(ss *snapshotter.Snapshotter) {
+		ss.Snapshot("a", 1)
+		ss.Snapshot("result", 1)
+		ss.Snapshot("result", 2)
+		ss.Snapshot("b", 2)
+	})
+
+	var m mockT
+	ss := snapshotter.New(&m)
+	ss.DiffFormat = snapshotter.DiffFormatStructural
+	ss.IgnoreOrder = true
+	ss.Snapshot("b", 2)
+	ss.Snapshot("result", 2)
+	ss.Snapshot("a", 1)
+	ss.Snapshot("result", 1)
+	ss.Verify()
+	if len(m.errors) != 0 {
+		t.Errorf("unexpected errors: %v", m.errors)
+	}
+
+	m.errors = nil
+	ss = snapshotter.New(&m)
+	ss.DiffFormat = snapshotter.DiffFormatStructural
+	ss.IgnoreOrder = true
+	ss.Snapshot("result", 3)
+	ss.Snapshot("result", 1)
+	ss.Snapshot("a", 1)
+	ss.Snapshot("b", 2)
+	ss.Verify()
+	if len(m.errors) == 0 || m.errors[0] != "snapshot result (#2) differs:\n~ $.Values[0]: 2 -> 3\n" {
+		t.Errorf("expected result (#2) to differ, got %v", m.errors)
+	}
+}
+
+func TestVerifyUnorderedPaths(t *testing.T) {
+	type value struct {
+		Items []int
+		Tags  [][]string
+	}
+
+	switchToTempWorkingDir(t)
+	rewriteMockSnapshots(t, func(ss *snapshotter.Snapshotter) {
+		ss.UnorderedPaths = []string{"$.Values[0].Items", "$.Values[0].Tags[*]"}
+		ss.Snapshot("value", value{Items: []int{3, 1, 2}, Tags: [][]string{{"b", "a"}, {"c"}}})
+	})
+
+	var m mockT
+	ss := snapshotter.New(&m)
+	ss.DiffFormat = snapshotter.DiffFormatStructural
+	ss.UnorderedPaths = []string{"$.Values[0].Items", "$.Values[0].Tags[*]"}
+	ss.Snapshot("value", value{Items: []int{2, 3, 1}, Tags: [][]string{{"a", "b"}, {"c"}}})
+	ss.Verify()
+	if len(m.errors) != 0 {
+		t.Errorf("unexpected errors: %v", m.errors)
+	}
+
+	// Order outside of the unordered paths still matters.
+	ss = snapshotter.New(&m)
+	ss.DiffFormat = snapshotter.DiffFormatStructural
+	ss.UnorderedPaths = []string{"$.Values[0].Items", "$.Values[0].Tags[*]"}
+	ss.Snapshot("value", value{Items: []int{1, 2, 3}, Tags: [][]string{{"c"}, {"a", "b"}}})
+	ss.Verify()
+	if len(m.errors) == 0 || !strings.Contains(m.errors[0], "> $.Values[0].Tags[0]: moved to [1]") {
+		t.Errorf("expected Tags to differ, got %v", m.errors)
+	}
+
+	m.errors = nil
+	ss = snapshotter.New(&m)
+	ss.DiffFormat = snapshotter.DiffFormatStructural
+	ss.UnorderedPaths = []string{"Values"}
+	ss.Snapshot("value", 1)
+	if len(m.errors) == 0 || !strings.Contains(m.errors[0], `invalid path "Values"`) {
+		t.Errorf("expected invalid path error, got %v", m.errors)
+	}
+}
+
+func TestVerifyMatchers(t *testing.T) {
+	type event struct {
+		ID        string
+		CreatedAt time.Time
+		Token     string
+		Attempts  int
+		Code      string
+	}
+	matchers := []snapshotter.Matcher{
+		snapshotter.AnyUUID("$.Values[*].ID"),
+		snapshotter.AnyRFC3339Time("$.Values[*].CreatedAt"),
+		snapshotter.Ignore("$.Values[*].Token"),
+		snapshotter.AnyNumber("$.Values[*].Attempts"),
+		snapshotter.MatchRegexp("$.Values[*].Code", "code", regexp.MustCompile(`^[A-Z]{3}$`)),
+	}
+
+	switchToTempWorkingDir(t)
+	rewriteMockSnapshots(t, func(ss *snapshotter.Snapshotter) {
+		ss.Matchers = matchers
+		ss.Snapshot("event", event{
+			ID:        "0b3c6bd4-4b6e-4f3c-9a53-8f4d5a0e4b1a",
+			CreatedAt: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+			Token:     "abc",
+			Attempts:  1,
+			Code:      "XYZ",
+		})
+	})
+
+	bytes, err := ioutil.ReadFile("testdata/MockTest.snapshots.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, placeholder := range []string{"<any UUID>", "<any RFC3339 time>", "<ignored>", "<any number>", "<code>"} {
+		if !strings.Contains(string(bytes), placeholder) {
+			t.Errorf("expected snapshot file to contain %s:\n%s", placeholder, bytes)
+		}
+	}
+
+	var m mockT
+	ss := snapshotter.New(&m)
+	ss.DiffFormat = snapshotter.DiffFormatStructural
+	ss.Matchers = matchers
+	ss.Snapshot("event", event{
+		ID:        "5f0e8f2c-8d9b-4c3e-b1a2-3c4d5e6f7a8b",
+		CreatedAt: time.Now(),
+		Token:     "def",
+		Attempts:  3,
+		Code:      "ABC",
+	})
+	ss.Verify()
+	if len(m.errors) != 0 {
+		t.Errorf("unexpected errors: %v", m.errors)
+	}
+
+	ss = snapshotter.New(&m)
+	ss.DiffFormat = snapshotter.DiffFormatStructural
+	ss.Matchers = matchers
+	ss.Snapshot("event", event{ID: "not a uuid", CreatedAt: time.Now(), Code: "abc"})
+	ss.Verify()
+	if len(m.errors) == 0 || m.errors[0] != "snapshot event differs:\n"+
+		"~ $.Values[0].Code: \"<code>\" -> \"abc\"\n"+
+		"~ $.Values[0].ID: \"<any UUID>\" -> \"not a uuid\"\n" {
+		t.Errorf("expected ID and Code to differ, got %v", m.errors)
+	}
+
+	// Only the placeholder is stored, so values are checked by the current
+	// Matchers.
+	m.errors = nil
+	ss = snapshotter.New(&m)
+	ss.Matchers = append(matchers[:4:4], snapshotter.MatchRegexp("$.Values[*].Code", "code", regexp.MustCompile(`^[a-z]{3}$`)))
+	ss.Snapshot("event", event{ID: "5f0e8f2c-8d9b-4c3e-b1a2-3c4d5e6f7a8b", CreatedAt: time.Now(), Code: "abc"})
+	ss.Verify()
+	if len(m.errors) != 0 {
+		t.Errorf("unexpected errors: %v", m.errors)
+	}
+}
+
+func TestVerifyFloatTolerance(t *testing.T) {
+	type point struct {
+		Lat, Lng float64
+		Speed    float64
+	}
+
+	testCases := []struct {
+		name   string
+		setup  func(ss *snapshotter.Snapshotter)
+		actual point
+		diff   string
+	}{
+		{
+			name:   "exact by default",
+			setup:  func(ss *snapshotter.Snapshotter) {},
+			actual: point{Lat: 37.77491, Lng: -122.4194, Speed: 100},
+			diff:   "~ $.Values[0].Lat: 37.7749 -> 37.77491\n",
+		},
+		{
+			name: "absolute",
+			setup: func(ss *snapshotter.Snapshotter) {
+				ss.FloatTolerance = snapshotter.FloatTolerance{Absolute: 0.001}
+			},
+			actual: point{Lat: 37.7751, Lng: -122.4199, Speed: 100.0005},
+		},
+		{
+			name: "relative",
+			setup: func(ss *snapshotter.Snapshotter) {
+				ss.FloatTolerance = snapshotter.FloatTolerance{Relative: 0.01}
+			},
+			actual: point{Lat: 37.7749, Lng: -122.4194, Speed: 101},
+		},
+		{
+			name: "exceeded",
+			setup: func(ss *snapshotter.Snapshotter) {
+				ss.FloatTolerance = snapshotter.FloatTolerance{Relative: 0.01}
+			},
+			actual: point{Lat: 37.7749, Lng: -122.4194, Speed: 102},
+			diff:   "~ $.Values[0].Speed: 100 -> 102 (delta 2)\n",
+		},
+		{
+			name: "per path",
+			setup: func(ss *snapshotter.Snapshotter) {
+				ss.PathFloatTolerances = map[string]snapshotter.FloatTolerance{
+					"$.Values[*].Lat": {Absolute: 0.001},
+					"$.Values[*].Lng": {Absolute: 0.001},
+				}
+			},
+			actual: point{Lat: 37.7751, Lng: -122.4199, Speed: 100.0005},
+			diff:   "~ $.Values[0].Speed: 100 -> 100.0005\n",
+		},
+		{
+			name: "most specific path",
+			setup: func(ss *snapshotter.Snapshotter) {
+				ss.PathFloatTolerances = map[string]snapshotter.FloatTolerance{
+					"$.Values[*].*":     {Absolute: 1},
+					"$.Values[*].Speed": {Absolute: 1},
+					"$.Values[0].Speed": {},
+					"$.*[0].Speed":      {Absolute: 1},
+				}
+			},
+			actual: point{Lat: 37.9749, Lng: -122.4194, Speed: 100.5},
+			diff:   "~ $.Values[0].Speed: 100 -> 100.5\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			switchToTempWorkingDir(t)
+			var expected []string
+			files := []string{"testdata/MockTest.snapshots.json"}
+			if tc.diff != "" {
+				expected = []string{"snapshot point differs:\n" + tc.diff, "1 differing: point", rewriteHint}
+				files = append(files, "testdata/MockTest.snapshots.json.new")
+			}
+			errors := runSnapshotSteps(t,
+				snapshotStep{
+					env: "REWRITE_SNAPSHOTS",
+					take: func(ss *snapshotter.Snapshotter) {
+						ss.Snapshot("point", point{Lat: 37.7749, Lng: -122.4194, Speed: 100})
+					},
+				},
+				snapshotStep{
+					take: func(ss *snapshotter.Snapshotter) {
+						ss.DiffFormat = snapshotter.DiffFormatStructural
+						tc.setup(ss)
+						ss.Snapshot("point", tc.actual)
+					},
+					errors: expected,
+				},
+			)
+			if len(expected) > 0 && len(errors) > 0 && errors[0] != expected[0] {
+				t.Errorf("expected:\n%s\ngot:\n%s", expected[0], errors[0])
+			}
+			assertFiles(t, "testdata", files...)
+		})
+	}
+}
+
+func TestSerializers(t *testing.T) {
+	type value struct {
+		ID    int64
+		Data  []byte
+		Names map[int]string
+	}
+	expected := value{ID: 1 << 60, Data: []byte("hi"), Names: map[int]string{2: "b", 1: "a"}}
+
+	testCases := []struct {
+		serializer snapshotter.Serializer
+		file       string
+		contents   string
+	}{
+		{
+			serializer: snapshotter.SerializerJSON,
+			file:       "testdata/MockTest.snapshots.json",
+			contents:   `"Data": "aGk="`,
+		},
+		{
+			serializer: snapshotter.SerializerYAML,
+			file:       "testdata/MockTest.snapshots.yaml",
+			contents:   "- name: value\n  values:\n    - Data: aGk=\n",
+		},
+		{
+			serializer: snapshotter.SerializerGoSyntax,
+			file:       "testdata/MockTest.snapshots.txt",
+			contents:   "=== value\n{\n ID: 1152921504606846976,\n Data: [\n  104,\n  105,\n ],\n Names: {\n  1: \"a\",\n  2: \"b\",\n },\n}\n---\n2\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.serializer.Extension(), func(t *testing.T) {
+			switchToTempWorkingDir(t)
+			rewriteMockSnapshots(t, func(ss *snapshotter.Snapshotter) {
+				ss.Serializer = tc.serializer
+				ss.Snapshot("value", expected, 2)
+			})
+
+			bytes, err := ioutil.ReadFile(tc.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(bytes), tc.contents) {
+				t.Errorf("expected %s to contain:\n%s\ngot:\n%s", tc.file, tc.contents, bytes)
+			}
+
+			var m mockT
+			ss := snapshotter.New(&m)
+			ss.Serializer = tc.serializer
+			ss.Snapshot("value", expected, 2)
+			ss.Verify()
+			if len(m.errors) != 0 {
+				t.Errorf("unexpected errors: %v", m.errors)
+			}
+
+			ss = snapshotter.New(&m)
+			ss.Serializer = tc.serializer
+			ss.Snapshot("value", expected, 3)
+			ss.Verify()
+			if len(m.errors) == 0 || !strings.Contains(m.errors[0], "snapshot value differs") {
+				t.Errorf("expected snapshot to differ, got %v", m.errors)
+			}
+		})
+	}
+}
+
+func TestSerializerGoSyntaxRejectsPathOptions(t *testing.T) {
+	switchToTempWorkingDir(t)
+
+	var m mockT
+	ss := snapshotter.New(&m)
+	ss.Serializer = snapshotter.SerializerGoSyntax
+	ss.UnorderedPaths = []string{"$.Values[0]"}
+	ss.Matchers = []snapshotter.Matcher{snapshotter.Ignore("$.Values[0]")}
+	ss.Snapshot("value", []int{1, 2})
+	ss.Verify()
+	if len(m.errors) != 1 || !strings.Contains(m.errors[0], "UnorderedPaths, Matchers cannot be used with a serializer that stores values as text") {
+		t.Errorf("expected path options error, got %v", m.errors)
+	}
+
+	m.errors = nil
+	ss = snapshotter.New(&m)
+	ss.Serializer = snapshotter.TypedSerializer(snapshotter.SerializerGoSyntax)
+	ss.PathFloatTolerances = map[string]snapshotter.FloatTolerance{"$.Values[0]": {Absolute: 0.1}}
+	ss.Snapshot("value", 1.0)
+	ss.Verify()
+	if len(m.errors) != 1 || !strings.Contains(m.errors[0], "PathFloatTolerances cannot be used") {
+		t.Errorf("expected path options error, got %v", m.errors)
+	}
+}
+
+type hiddenState struct {
+	Visible string
+	Hidden  string
+}
+
+func (h hiddenState) MarshalJSON() ([]byte, error) {
+	return json.Marshal(h.Visible)
+}
+
+func TestTypedSerializer(t *testing.T) {
+	type value struct {
+		Timeout time.Duration
+		Created time.Time
+		Names   map[int]string
+		Tags    []string
+		Empty   []string
+		Next    *value
+		State   hiddenState
+		Data    []byte
+		Binary  []byte
+		ID      int64
+		Count   uint64
+		Keys    map[string]int
+		Limit   *int
+		Missing *int
+		Labels  *[]string
+	}
+	limit := 1
+	actual := value{
+		Timeout: 1500 * time.Millisecond,
+		Created: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		Names:   map[int]string{1: "a"},
+		Empty:   []string{},
+		Next:    &value{},
+		State:   hiddenState{Visible: "v", Hidden: "h"},
+		Data:    []byte("hi"),
+		Binary:  []byte{0xff, 0x00},
+		ID:      1<<53 + 1,
+		Count:   1 << 63,
+		Keys:    map[string]int{"$type": 1},
+		Limit:   &limit,
+		Labels:  &[]string{"a"},
+	}
+
+	switchToTempWorkingDir(t)
+	rewriteMockSnapshots(t, func(ss *snapshotter.Snapshotter) {
+		ss.Serializer = snapshotter.TypedSerializer(snapshotter.SerializerJSON)
+		ss.Snapshot("value", actual)
+	})
+
+	bytes, err := ioutil.ReadFile("testdata/MockTest.snapshots.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	compact := strings.Join(strings.Fields(string(bytes)), "")
+	for _, contents := range []string{
+		`"$type":"snapshotter_test.value"`,
+		`"Timeout":{"$type":"time.Duration","$value":1500000000}`,
+		`"Created":{"$type":"time.Time","$value":"2020-01-02T03:04:05Z"}`,
+		`"Names":{"$type":"map[int]string","1":"a"}`,
+		`"Tags":null`,
+		`"Empty":[]`,
+		`"Next":{"$type":"*snapshotter_test.value"`,
+		`"Hidden":"h"`,
+		`"Data":{"$type":"[]uint8","$value":"hi"}`,
+		`"Binary":{"$encoding":"base64","$type":"[]uint8","$value":"/wA="}`,
+		`"ID":{"$type":"int64","$value":"9007199254740993"}`,
+		`"Count":{"$type":"uint64","$value":"9223372036854775808"}`,
+		`"Keys":{"$$type":1,"$type":"map[string]int"}`,
+		`"Limit":{"$type":"*int","$value":1}`,
+		`"Missing":{"$type":"*int","$value":null}`,
+		`"Labels":{"$type":"*[]string","$value":["a"]}`,
+	} {
+		if !strings.Contains(compact, contents) {
+			t.Errorf("expected snapshot file to contain %s, got:\n%s", contents, bytes)
+		}
+	}
+
+	var m mockT
+	ss := snapshotter.New(&m)
+	ss.DiffFormat = snapshotter.DiffFormatStructural
+	ss.Serializer = snapshotter.TypedSerializer(snapshotter.SerializerJSON)
+	ss.Snapshot("value", actual)
+	ss.Verify()
+	if len(m.errors) != 0 {
+		t.Errorf("unexpected errors: %v", m.errors)
+	}
+
+	ss = snapshotter.New(&m)
+	ss.DiffFormat = snapshotter.DiffFormatStructural
+	ss.Serializer = snapshotter.TypedSerializer(snapshotter.SerializerJSON)
+	actual.State.Hidden = "changed"
+	ss.Snapshot("value", actual)
+	ss.Verify()
+	if len(m.errors) == 0 || !strings.Contains(m.errors[0], `~ $.Values[0].State.Hidden: "h" -> "changed"`) {
+		t.Errorf("expected hidden state to differ, got %v", m.errors)
+	}
+
+	m.errors = nil
+	ss = snapshotter.New(&m)
+	ss.DiffFormat = snapshotter.DiffFormatStructural
+	ss.Serializer = snapshotter.TypedSerializer(snapshotter.SerializerJSON)
+	cyclic := &value{}
+	cyclic.Next = cyclic
+	ss.Snapshot("value", cyclic)
+	if len(m.errors) == 0 || !strings.Contains(m.errors[0], "cycle through *snapshotter_test.value") {
+		t.Errorf("expected cycle error, got %v", m.errors)
+	}
+}
+
+func TestSidecarFiles(t *testing.T) {
+	const query = "SELECT *\nFROM users\nWHERE id = 1\n"
+	takeQueries := func(first string) func(ss *snapshotter.Snapshotter) {
+		return func(ss *snapshotter.Snapshotter) {
+			ss.TextFiles = true
+			ss.Snapshot("query", first)
+			ss.Snapshot("query", "SELECT 1\nFROM dual")
+			ss.Snapshot("short", "one line")
+		}
+	}
+
+	takeBytes := func(exportFile string) func(ss *snapshotter.Snapshotter) {
+		return func(ss *snapshotter.Snapshotter) {
+			ss.SnapshotBytes("proto", []byte{0x08, 0x96, 0x01})
+			ss.SnapshotFile("export", exportFile)
+			ss.Snapshot("value", 1)
+		}
+	}
+
+	testCases := []struct {
+		name string
+		// fixtures are files written to the working directory first.
+		fixtures map[string]string
+		steps    []snapshotStep
+		// files are the files in testdata afterwards.
+		files []string
+		// contents are the contents of some of the files.
+		contents map[string]string
+	}{
+		{
+			name: "multi-line strings",
+			steps: []snapshotStep{
+				{env: "REWRITE_SNAPSHOTS", take: takeQueries(query)},
+				{
+					take:   takeQueries(strings.Replace(query, "1", "2", 1)),
+					errors: []string{"-WHERE id = 1\n+WHERE id = 2\n", "1 differing: query", rewriteHint},
+				},
+			},
+			files: []string{
+				"testdata/MockTest.snapshots.json",
+				"testdata/MockTest.snapshots.json.new",
+				"testdata/MockTest/query.txt",
+				"testdata/MockTest/query.txt.new",
+				"testdata/MockTest/query_2.txt",
+				"testdata/MockTest/query_2.txt.new",
+			},
+			contents: map[string]string{
+				"testdata/MockTest/query.txt":     query,
+				"testdata/MockTest/query.txt.new": strings.Replace(query, "1", "2", 1),
+				"testdata/MockTest/query_2.txt":   "SELECT 1\nFROM dual",
+			},
+		},
+		{
+			name: "removed multi-line strings",
+			steps: []snapshotStep{
+				{env: "REWRITE_SNAPSHOTS", take: takeQueries(query)},
+				{env: "REWRITE_SNAPSHOTS", take: func(ss *snapshotter.Snapshotter) {
+					ss.TextFiles = true
+					ss.Snapshot("short", "one line")
+				}},
+			},
+			files: []string{"testdata/MockTest.snapshots.json"},
+		},
+		{
+			name: "colliding names",
+			steps: []snapshotStep{
+				{env: "REWRITE_SNAPSHOTS", take: takeCollidingNames},
+				{take: takeCollidingNames},
+			},
+			files: []string{
+				"testdata/MockTest.snapshots.json",
+				"testdata/MockTest/A_B_3.txt",
+				"testdata/MockTest/a_b.txt",
+				"testdata/MockTest/a_b_2.txt",
+				"testdata/MockTest/files/c_d.bin",
+				"testdata/MockTest/files/c_d_2.bin",
+			},
+			contents: map[string]string{
+				"testdata/MockTest/a_b.txt":         "first\n",
+				"testdata/MockTest/a_b_2.txt":       "second\n",
+				"testdata/MockTest/A_B_3.txt":       "third\n",
+				"testdata/MockTest/files/c_d.bin":   "\x01",
+				"testdata/MockTest/files/c_d_2.bin": "\x02",
+			},
+		},
+		{
+			name:     "bytes and files",
+			fixtures: map[string]string{"export.csv": "id,name\n1,a\n"},
+			steps: []snapshotStep{
+				{env: "REWRITE_SNAPSHOTS", take: takeBytes("export.csv")},
+				{take: takeBytes("export.csv")},
+			},
+			files: []string{
+				"testdata/MockTest.snapshots.json",
+				"testdata/MockTest/files/export.csv",
+				"testdata/MockTest/files/proto.bin",
+			},
+			contents: map[string]string{
+				"testdata/MockTest/files/proto.bin":  "\x08\x96\x01",
+				"testdata/MockTest/files/export.csv": "id,name\n1,a\n",
+			},
+		},
+		{
+			name:     "differing bytes and files",
+			fixtures: map[string]string{"export.csv": "id,name\n1,a\n", "changed.csv": "id,name\n1,b\n"},
+			steps: []snapshotStep{
+				{env: "REWRITE_SNAPSHOTS", take: takeBytes("export.csv")},
+				{
+					take: func(ss *snapshotter.Snapshotter) {
+						ss.TextByteDiff = true
+						ss.SnapshotBytes("proto", []byte{0x08, 0x97, 0x01})
+						ss.SnapshotFile("export", "changed.csv")
+						ss.Snapshot("value", 1)
+					},
+					errors: []string{
+						"snapshot proto differs:\nexpected 3 bytes, got 3 bytes\n--- expected\n+++ received\n@@ -1,2 +1,2 @@\n-00000000  08 96 01",
+						"-1,a\n+1,b\n",
+						"2 differing: proto, export",
+						rewriteHint,
+					},
+				},
+			},
+			files: []string{
+				"testdata/MockTest.snapshots.json",
+				"testdata/MockTest.snapshots.json.new",
+				"testdata/MockTest/files/export.csv",
+				"testdata/MockTest/files/export.csv.new",
+				"testdata/MockTest/files/proto.bin",
+				"testdata/MockTest/files/proto.bin.new",
+			},
+			contents: map[string]string{
+				"testdata/MockTest/files/proto.bin.new":  "\x08\x97\x01",
+				"testdata/MockTest/files/export.csv.new": "id,name\n1,b\n",
+			},
+		},
+		{
+			name:     "removed file",
+			fixtures: map[string]string{"export.csv": "id,name\n1,a\n"},
+			steps: []snapshotStep{
+				{env: "REWRITE_SNAPSHOTS", take: takeBytes("export.csv")},
+				{env: "REWRITE_SNAPSHOTS", take: func(ss *snapshotter.Snapshotter) {
+					ss.SnapshotBytes("proto", []byte{0x08, 0x96, 0x01})
+				}},
+			},
+			files: []string{"testdata/MockTest.snapshots.json", "testdata/MockTest/files/proto.bin"},
+		},
+		{
+			name: "bytes with go syntax",
+			steps: []snapshotStep{
+				{env: "REWRITE_SNAPSHOTS", take: takeGoSyntaxBytes},
+				{take: takeGoSyntaxBytes},
+			},
+			files:    []string{"testdata/MockTest.snapshots.txt", "testdata/MockTest/files/proto.bin"},
+			contents: map[string]string{"testdata/MockTest/files/proto.bin": "\x08\x96\x01"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			switchToTempWorkingDir(t)
+			for name, contents := range tc.fixtures {
+				if err := ioutil.WriteFile(name, []byte(contents), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			runSnapshotSteps(t, tc.steps...)
+			assertFiles(t, "testdata", tc.files...)
+			for name, expected := range tc.contents {
+				if data, err := ioutil.ReadFile(name); err != nil || string(data) != expected {
+					t.Errorf("expected %s to contain %q, got %q %v", name, expected, data, err)
+				}
+			}
+		})
+	}
+}
+
+// takeGoSyntaxBytes takes a byte snapshot stored with SerializerGoSyntax.
+func takeGoSyntaxBytes(ss *snapshotter.Snapshotter) {
+	ss.Serializer = snapshotter.SerializerGoSyntax
+	ss.SnapshotBytes("proto", []byte{0x08, 0x96, 0x01})
+}
+
+// takeCollidingNames takes snapshots whose names map to the same sidecar file
+// name.
+func takeCollidingNames(ss *snapshotter.Snapshotter) {
+	ss.TextFiles = true
+	ss.Snapshot("a b", "first\n")
+	ss.Snapshot("a_b", "second\n")
+	ss.Snapshot("A_B", "third\n")
+	ss.SnapshotBytes("c d", []byte{1})
+	ss.SnapshotBytes("c_d", []byte{2})
+}
+
+func TestRewriteKeepsFilesOfOtherSnapshotFiles(t *testing.T) {
+	testCases := []struct {
+		name       string
+		serializer snapshotter.Serializer
+		child      string
+		// takeParent takes a snapshot named name in the parent test.
+		takeParent func(ss *snapshotter.Snapshotter, name string)
+		// files are the files in testdata after the parent snapshots changed.
+		files []string
+	}{
+		{
+			name:       "go syntax subtest",
+			serializer: snapshotter.SerializerGoSyntax,
+			child:      "TestParent/child",
+			takeParent: func(ss *snapshotter.Snapshotter, name string) {
+				ss.Snapshot(name, 1)
+			},
+			files: []string{"testdata/TestParent.snapshots.txt", "testdata/TestParent/child.snapshots.txt"},
+		},
+		{
+			name:       "subtest named files",
+			serializer: snapshotter.SerializerJSON,
+			child:      "TestParent/files",
+			takeParent: func(ss *snapshotter.Snapshotter, name string) {
+				ss.SnapshotBytes(name, []byte{1})
+			},
+			// The file of the old parent snapshot, files/old.bin, is removed.
+			files: []string{"testdata/TestParent.snapshots.json", "testdata/TestParent/files.snapshots.json", "testdata/TestParent/files/text.txt", "testdata/TestParent/files/new.bin"},
+		},
+	}
+
+	for _, tc := range testCases {
+		for _, resolve := range []string{"rewrite", "accept"} {
+			t.Run(tc.name+"/"+resolve, func(t *testing.T) {
+				switchToTempWorkingDir(t)
+				setRewriteSnapshotsEnv(t)
+				newSnapshotter := func(name string) (*snapshotter.Snapshotter, *mockCleanupT) {
+					m := &mockCleanupT{name: name}
+					ss := snapshotter.New(m)
+					ss.FileName = snapshotter.NestedFileName
+					ss.Serializer = tc.serializer
+					ss.TextFiles = true
+					return ss, m
+				}
+				takeChild := func() []string {
+					ss, m := newSnapshotter(tc.child)
+					ss.Snapshot("text", "line 1\nline 2\n")
+					ss.Verify()
+					return m.errors
+				}
+				takeParent := func(name string) (string, []string) {
+					ss, m := newSnapshotter("TestParent")
+					tc.takeParent(ss, name)
+					ss.Verify()
+					return ss.SnapshotFileName(), m.errors
+				}
+
+				takeChild()
+				takeParent("old")
+				if resolve == "rewrite" {
+					takeParent("new")
+				} else {
+					if err := os.Setenv("REWRITE_SNAPSHOTS", "0"); err != nil {
+						t.Fatal(err)
+					}
+					name, errors := takeParent("new")
+					if len(errors) == 0 {
+						t.Fatal("expected the parent snapshots to differ")
+					}
+					change, err := snapshotter.PendingChangeOf(name)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if err := change.Accept(); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				assertFiles(t, "testdata", tc.files...)
+				if err := os.Setenv("REWRITE_SNAPSHOTS", "0"); err != nil {
+					t.Fatal(err)
+				}
+				if errors := takeChild(); len(errors) != 0 {
+					t.Errorf("unexpected errors checking the subtest: %v", errors)
+				}
+				if _, errors := takeParent("new"); len(errors) != 0 {
+					t.Errorf("unexpected errors checking the parent: %v", errors)
+				}
+			})
+		}
+	}
+}
+
+func TestSnapshottersSharingFile(t *testing.T) {
+	snapshotConcurrently := func(ss *snapshotter.Snapshotter) {
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				ss.Snapshot(fmt.Sprintf("value %d", i), i)
+			}(i)
+		}
+		wg.Wait()
+	}
+
+	testCases := []struct {
+		name string
+		// run takes and verifies the snapshots, and returns the errors that
+		// weren't checked by runSnapshotSteps.
+		run    func(t *testing.T) []string
+		errors []string
+	}{
+		{
+			// Concurrent snapshots don't leave temporary files behind.
+			name: "concurrent snapshots",
+			run: func(t *testing.T) []string {
+				runSnapshotSteps(t,
+					snapshotStep{env: "REWRITE_SNAPSHOTS", take: snapshotConcurrently},
+					snapshotStep{take: func(ss *snapshotter.Snapshotter) {
+						ss.IgnoreOrder = true
+						snapshotConcurrently(ss)
+					}},
+				)
+				return nil
+			},
+		},
+		{
+			// The file can be used again once the first Snapshotter is
+			// verified.
+			name: "shared file",
+			run: func(t *testing.T) []string {
+				setRewriteSnapshotsEnv(t)
+				m := &mockCleanupT{name: "MockTest"}
+				first := snapshotter.New(m)
+				second := snapshotter.New(m)
+				first.Snapshot("first", 1)
+				second.Snapshot("second", 2)
+				first.Verify()
+				third := snapshotter.New(m)
+				third.Snapshot("third", 3)
+				third.Verify()
+				return m.errors
+			},
+			errors: []string{"snapshot file testdata/MockTest.snapshots.json is already used by another Snapshotter"},
+		},
+		{
+			// Nothing would release the snapshot file of a Snapshotter that is
+			// never verified if its T doesn't support Cleanup, so it must not
+			// be claimed before Verify.
+			name: "unverified without Cleanup",
+			run: func(t *testing.T) []string {
+				setRewriteSnapshotsEnv(t)
+				var m mockT
+				unverified := snapshotter.New(&m)
+				unverified.Snapshot("first", 1)
+				ss := snapshotter.New(&m)
+				ss.Snapshot("second", 2)
+				ss.Verify()
+				return m.errors
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			switchToTempWorkingDir(t)
+			errors := tc.run(t)
+			if len(errors) != len(tc.errors) {
+				t.Errorf("expected errors containing %q, got %q", tc.errors, errors)
+			} else {
+				for i, expected := range tc.errors {
+					if !strings.Contains(errors[i], expected) {
+						t.Errorf("expected error containing %q, got %q", expected, errors[i])
+					}
+				}
+			}
+			assertFiles(t, "testdata", "testdata/MockTest.snapshots.json")
+		})
+	}
+}
+
+// mockCleanupT is a mockT that supports Cleanup and subtests.
+type mockCleanupT struct {
+	mockT
+	name     string
+	cleanups []func()
+	skipped  bool
+}
+
+func (m *mockCleanupT) Skipped() bool {
+	return m.skipped
+}
+
+func (m *mockCleanupT) Name() string {
+	return m.name
+}
+
+func (m *mockCleanupT) Cleanup(f func()) {
+	m.cleanups = append(m.cleanups, f)
+}
+
+// finish runs the cleanup functions like a finished test does.
+func (m *mockCleanupT) finish() {
+	for i := len(m.cleanups) - 1; i >= 0; i-- {
+		m.cleanups[i]()
+	}
+}
+
+func TestNewWithCleanup(t *testing.T) {
+	takeSnapshots := func(m *mockCleanupT) []*mockCleanupT {
+		ss := snapshotter.NewWithCleanup(m)
+		ss.Snapshot("root", 0)
+		var subtests []*mockCleanupT
+		// Subtests finishing in a different order don't change the order of
+		// the snapshots.
+		for _, name := range []string{"b", "a"} {
+			subtest := &mockCleanupT{name: m.name + "/" + name}
+			child := ss.Child(subtest)
+			child.Snapshot("value", name)
+			child.Child(&mockCleanupT{name: subtest.name + "/nested"}).Snapshot("value", name)
+			subtests = append(subtests, subtest)
+		}
+		m.finish()
+		return subtests
+	}
+
+	switchToTempWorkingDir(t)
+	setRewriteSnapshotsEnv(t)
+	m := &mockCleanupT{name: "MockTest"}
+	takeSnapshots(m)
+	if len(m.errors) != 0 {
+		t.Fatalf("unexpected errors: %v", m.errors)
+	}
+	bytes, err := ioutil.ReadFile("testdata/MockTest.snapshots.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored []struct{ Name string }
+	if err := json.Unmarshal(bytes, &stored); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, snapshot := range stored {
+		names = append(names, snapshot.Name)
+	}
+	if expected := "root, a/value, a/nested/value, b/value, b/nested/value"; strings.Join(names, ", ") != expected {
+		t.Errorf("expected snapshots %s, got %s", expected, strings.Join(names, ", "))
+	}
+
+	if err := os.Setenv("REWRITE_SNAPSHOTS", "0"); err != nil {
+		t.Fatal(err)
+	}
+	m = &mockCleanupT{name: "MockTest"}
+	for _, subtest := range takeSnapshots(m) {
+		if len(subtest.errors) != 0 {
+			t.Errorf("unexpected errors in %s: %v", subtest.name, subtest.errors)
+		}
+	}
+	if len(m.errors) != 0 {
+		t.Errorf("unexpected errors: %v", m.errors)
+	}
+
+	subtest := &mockCleanupT{name: "OtherTest/a"}
+	snapshotter.New(&mockCleanupT{name: "MockTest"}).Child(subtest)
+	if len(subtest.errors) != 1 || subtest.errors[0] != "OtherTest/a is not a subtest of MockTest" {
+		t.Errorf("expected error for test that is not a subtest, got %v", subtest.errors)
+	}
+}
+
+func TestNewWithCleanupVerifiedExplicitly(t *testing.T) {
+	switchToTempWorkingDir(t)
+	rewriteMockSnapshots(t, func(ss *snapshotter.Snapshotter) {
+		ss.Snapshot("value", 1)
+	})
+
+	for _, tc := range []struct {
+		name   string
+		verify func(ss *snapshotter.Snapshotter)
+	}{
+		{name: "Verify", verify: (*snapshotter.Snapshotter).Verify},
+		{name: "VerifyWithImage", verify: func(ss *snapshotter.Snapshotter) {
+			ss.VerifyWithImage(shadedRenderFn(0, 0))
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var expected mockT
+			ss := snapshotter.New(&expected)
+			ss.Snapshot("value", 2)
+			tc.verify(ss)
+
+			m := &mockCleanupT{name: "MockTest"}
+			ss = snapshotter.NewWithCleanup(m)
+			ss.Snapshot("value", 2)
+			tc.verify(ss)
+			m.finish()
+			if len(expected.errors) == 0 || strings.Join(m.errors, "\n") != strings.Join(expected.errors, "\n") {
+				t.Errorf("expected errors %v to be reported once, got %v", expected.errors, m.errors)
+			}
+		})
+	}
+
+	// Snapshots taken after Verify are still verified when the test finishes.
+	m := &mockCleanupT{name: "MockTest"}
+	ss := snapshotter.NewWithCleanup(m)
+	ss.Snapshot("value", 1)
+	ss.Verify()
+	ss.Snapshot("other", 2)
+	m.finish()
+	if len(m.errors) == 0 || !strings.Contains(m.errors[0], "1 extra: other") {
+		t.Errorf("expected the new snapshot to be reported, got %v", m.errors)
+	}
+}
+
+func TestSnapshotterNeverVerified(t *testing.T) {
+	switchToTempWorkingDir(t)
+
+	m := &mockCleanupT{name: "MockTest"}
+	ss := snapshotter.New(m)
+	ss.Snapshot("value", 1)
+	m.finish()
+	if len(m.errors) != 1 || !strings.Contains(m.errors[0], "snapshots in testdata/MockTest.snapshots.json were taken but never verified") {
+		t.Errorf("expected unverified snapshots to be reported, got %v", m.errors)
+	}
+
+	m = &mockCleanupT{name: "MockTest"}
+	snapshotter.New(m)
+	m.finish()
+	if len(m.errors) != 0 {
+		t.Errorf("unexpected errors: %v", m.errors)
+	}
+}
+
 func TestSnapshotterNoSnapshots(t *testing.T) {
 	ss := snapshotter.New(t)
 	ss.Verify()
@@ -119,6 +1396,103 @@ func TestSnapshotterInvalidFlags(t *testing.T) {
 	}
 }
 
+func TestSnapshotModeInvalidFlags(t *testing.T) {
+	testCases := []struct {
+		env   []string
+		error string
+	}{
+		{
+			env:   []string{"WRITE_NEW_SNAPSHOTS", "REWRITE_SNAPSHOTS"},
+			error: "writeNewSnapshots never rewrites existing snapshots",
+		},
+		{
+			env:   []string{"SNAPSHOTS_CI", "REWRITE_WITH_FAIL_ON_DIFF"},
+			error: "snapshots are never written in CI",
+		},
+		{
+			env:   []string{"SNAPSHOTS_CI", "WRITE_NEW_SNAPSHOTS"},
+			error: "snapshots are never written in CI",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(strings.Join(tc.env, "+"), func(t *testing.T) {
+			for _, env := range tc.env {
+				t.Setenv(env, "1")
+			}
+			if _, err := snapshotter.GlobalSnapshotMode(); err == nil || !strings.Contains(err.Error(), tc.error) {
+				t.Errorf("expected error %q, got %v", tc.error, err)
+			}
+		})
+	}
+}
+
+func TestVerifyWriteNew(t *testing.T) {
+	switchToTempWorkingDir(t)
+	t.Setenv("WRITE_NEW_SNAPSHOTS", "1")
+
+	var m mockT
+	ss := snapshotter.New(&m)
+	ss.Snapshot("value", 1)
+	ss.VerifyWithImage(tinyRenderFn)
+	if len(m.errors) != 0 {
+		t.Fatalf("unexpected errors: %v", m.errors)
+	}
+	for _, name := range []string{"testdata/MockTest.snapshots.json", "testdata/MockTest/value.png"} {
+		if _, err := os.Stat(name); err != nil {
+			t.Errorf("expected %s to be written: %s", name, err)
+		}
+	}
+
+	ss = snapshotter.New(&m)
+	ss.Snapshot("value", 2)
+	ss.VerifyWithImage(tinyRenderFn)
+	if len(m.errors) == 0 || !strings.Contains(m.errors[0], "snapshot value differs") {
+		t.Errorf("expected existing snapshot to be checked, got %v", m.errors)
+	}
+	bytes, err := ioutil.ReadFile("testdata/MockTest.snapshots.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(bytes), "1") || strings.Contains(string(bytes), "2") {
+		t.Errorf("expected existing snapshot not to be rewritten, got %s", bytes)
+	}
+}
+
+func TestVerifyCI(t *testing.T) {
+	switchToTempWorkingDir(t)
+	rewriteMockSnapshots(t, func(ss *snapshotter.Snapshotter) {
+		ss.Snapshot("changed", 1)
+	})
+	t.Setenv("SNAPSHOTS_CI", "1")
+
+	var m mockT
+	ss := snapshotter.New(&m)
+	ss.Snapshot("changed", 2)
+	ss.Snapshot("new", 3)
+	ss.Verify()
+	if len(m.errors) < 2 || !strings.Contains(m.errors[1], "1 differing: changed\n  1 never committed: new") {
+		t.Errorf("expected changed and new snapshots to be reported separately, got %v", m.errors)
+	}
+
+	m.errors = nil
+	ss = snapshotter.NewNamed(&m, "new")
+	ss.Snapshot("value", 1)
+	ss.Verify()
+	if len(m.errors) != 1 || !strings.Contains(m.errors[0], "snapshot file testdata/MockTest_new.snapshots.json was never committed") {
+		t.Errorf("expected new snapshot file to be reported, got %v", m.errors)
+	}
+	if _, err := os.Stat("testdata/MockTest_new.snapshots.json"); !os.IsNotExist(err) {
+		t.Errorf("expected snapshot file not to be written in CI")
+	}
+
+	m.errors = nil
+	snapshotter.Inline(&m, "value", "")
+	if len(m.errors) != 1 || !strings.Contains(m.errors[0], "inline snapshot \"value\" was never committed") {
+		t.Errorf("expected new inline snapshot to be reported, got %v", m.errors)
+	}
+}
+
 func TestVerifyWithImage(t *testing.T) {
 	renderFn := func(values []interface{}) (image.Image, error) {
 		length := 256
@@ -215,6 +1589,106 @@ func TestVerifyWithImageNoSnapshots(t *testing.T) {
 	}
 }
 
+// shadedRenderFn renders a 10x10 image whose first changedRows rows have a red
+// channel of values[0] + delta.
+func shadedRenderFn(delta uint8, changedRows int) snapshotter.RenderFn {
+	return func(values []interface{}) (image.Image, error) {
+		img := image.NewRGBA(image.Rect(0, 0, 10, 10))
+		for y := 0; y < 10; y++ {
+			r := uint8(values[0].(float64))
+			if y < changedRows {
+				r += delta
+			}
+			for x := 0; x < 10; x++ {
+				img.Set(x, y, color.RGBA{R: r, A: 255})
+			}
+		}
+		return img, nil
+	}
+}
+
+func TestVerifyWithImageComparison(t *testing.T) {
+	testCases := []struct {
+		name string
+		// stored renders the stored image, which is shadedRenderFn(0, 0) if it
+		// is nil.
+		stored     snapshotter.RenderFn
+		env        string
+		renderFn   snapshotter.RenderFn
+		comparison snapshotter.ImageComparison
+		tolerance  snapshotter.ImageTolerance
+		errors     []string
+	}{
+		{name: "identical", renderFn: shadedRenderFn(0, 0)},
+		{name: "changed", renderFn: shadedRenderFn(5, 10), errors: []string{"image for snapshot image differs", rewriteHint}},
+		{name: "within channel tolerance", renderFn: shadedRenderFn(5, 10), tolerance: snapshotter.ImageTolerance{Channel: 5}},
+		{name: "within ratio", renderFn: shadedRenderFn(50, 1), tolerance: snapshotter.ImageTolerance{MaxDiffRatio: 0.1}},
+		{name: "above ratio", renderFn: shadedRenderFn(50, 2), tolerance: snapshotter.ImageTolerance{MaxDiffRatio: 0.1}, errors: []string{"image for snapshot image differs", rewriteHint}},
+		{name: "perceptual changed", renderFn: shadedRenderFn(5, 10), comparison: snapshotter.ImageComparisonPerceptual, errors: []string{"anti-aliased pixels ignored", rewriteHint}},
+		{name: "perceptual within threshold", renderFn: shadedRenderFn(5, 10), comparison: snapshotter.ImageComparisonPerceptual, tolerance: snapshotter.ImageTolerance{Threshold: 0.1}},
+		{name: "ssim identical", renderFn: shadedRenderFn(0, 0), comparison: snapshotter.ImageComparisonSSIM},
+		{name: "ssim changed", renderFn: shadedRenderFn(50, 3), comparison: snapshotter.ImageComparisonSSIM, errors: []string{"SSIM is", rewriteHint}},
+		{name: "ssim within minimum", renderFn: shadedRenderFn(50, 3), comparison: snapshotter.ImageComparisonSSIM, tolerance: snapshotter.ImageTolerance{MinSSIM: 0.1}},
+		{name: "anti-aliased edge", stored: edgeRenderFn(false), renderFn: edgeRenderFn(true), errors: []string{"image for snapshot image differs", rewriteHint}},
+		{name: "perceptual anti-aliased edge", stored: edgeRenderFn(false), renderFn: edgeRenderFn(true), comparison: snapshotter.ImageComparisonPerceptual},
+		// The diff image is kept when the image is rewritten after it differed.
+		{name: "rewrite with fail on diff", env: "REWRITE_WITH_FAIL_ON_DIFF", renderFn: shadedRenderFn(5, 10), errors: []string{"see testdata/MockTest/image.diff.png", rewriteHint}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			switchToTempWorkingDir(t)
+			stored := tc.stored
+			if stored == nil {
+				stored = shadedRenderFn(0, 0)
+			}
+			runSnapshotSteps(t,
+				snapshotStep{
+					env:      "REWRITE_SNAPSHOTS",
+					take:     func(ss *snapshotter.Snapshotter) { ss.Snapshot("image", 200) },
+					renderFn: stored,
+				},
+				snapshotStep{
+					env: tc.env,
+					take: func(ss *snapshotter.Snapshotter) {
+						ss.ImageComparison = tc.comparison
+						ss.ImageTolerance = tc.tolerance
+						ss.Snapshot("image", 200)
+					},
+					renderFn: tc.renderFn,
+					errors:   tc.errors,
+				},
+			)
+
+			files := []string{"testdata/MockTest.snapshots.json", "testdata/MockTest/image.png"}
+			if tc.errors != nil {
+				files = append(files, "testdata/MockTest/image.diff.png")
+			}
+			assertFiles(t, "testdata", files...)
+		})
+	}
+}
+
+// edgeRenderFn renders a 10x10 image that is black on the left and white on the
+// right. When antialiased is set, the column between them is gray.
+func edgeRenderFn(antialiased bool) snapshotter.RenderFn {
+	return func(values []interface{}) (image.Image, error) {
+		img := image.NewRGBA(image.Rect(0, 0, 10, 10))
+		for y := 0; y < 10; y++ {
+			for x := 0; x < 10; x++ {
+				c := color.RGBA{A: 255}
+				if x >= 5 {
+					c = color.RGBA{R: 255, G: 255, B: 255, A: 255}
+				}
+				if antialiased && x == 5 {
+					c = color.RGBA{R: 128, G: 128, B: 128, A: 255}
+				}
+				img.Set(x, y, c)
+			}
+		}
+		return img, nil
+	}
+}
+
 func TestSnapshotFileName(t *testing.T) {
 	ss := snapshotter.New(t)
 	expected := fmt.Sprintf("testdata/%s.snapshots.json", t.Name())
@@ -229,3 +1703,631 @@ func TestSnapshotFileName(t *testing.T) {
 	}
 
 }
+
+func TestInline(t *testing.T) {
+	var m mockT
+	snapshotter.Inline(&m, "gopher", "gopher")
+	snapshotter.Inline(&m, []int{1, 2, 3}, "[1,2,3]")
+	snapshotter.Inline(&m, map[string]string{"html": "<b>"}, `{"html":"<b>"}`)
+	if len(m.errors) != 0 {
+		t.Errorf("unexpected errors: %v", m.errors)
+	}
+
+	snapshotter.Inline(&m, "line 1\nline 2", "line 1\nline 3")
+	if len(m.errors) == 0 || !strings.Contains(m.errors[0], "-line 3\n+line 2") {
+		t.Errorf("expected inline snapshot to differ, got %v", m.errors)
+	}
+}
+
+type mockM struct {
+	run func()
+}
+
+func (m mockM) Run() int {
+	m.run()
+	return 0
+}
+
+func TestMainObsoleteSnapshots(t *testing.T) {
+	testCases := []struct {
+		name string
+		// dir holds the snapshot files.
+		dir string
+		// obsolete are the files of obsolete snapshots, which are written
+		// before the snapshots are taken and deleted by Main.
+		obsolete []string
+		// fixtures are written before the snapshots are taken, and kept.
+		fixtures []string
+		// run takes the snapshots and returns the errors reported.
+		run func() []string
+		// snapshots are the files of the snapshots taken by run.
+		snapshots []string
+	}{
+		{
+			name: "flat",
+			dir:  "testdata",
+			obsolete: []string{
+				"testdata/TestRenamed.snapshots.json",
+				"testdata/TestRenamed/value.png",
+			},
+			fixtures: []string{
+				"testdata/fixtures/input.json",
+				// Fixtures that look like the files of snapshots are not
+				// snapshots.
+				"testdata/golden/input.txt",
+				"testdata/golden/expected.png",
+				"testdata/golden/files/data.bin",
+			},
+			run: func() []string {
+				var m mockT
+				ss := snapshotter.New(&m)
+				ss.Snapshot("value", 1)
+				ss.Verify()
+				return m.errors
+			},
+			snapshots: []string{"testdata/MockTest.snapshots.json"},
+		},
+		{
+			name: "nested subtest",
+			dir:  "snapshots",
+			obsolete: []string{
+				"snapshots/MockTest/renamed.snapshots.json",
+				"snapshots/MockTest/renamed/value.txt",
+			},
+			fixtures: []string{"snapshots/MockTest/fixture.txt"},
+			run: func() []string {
+				var errors []string
+				for _, name := range []string{"MockTest", "MockTest/case"} {
+					m := &mockCleanupT{name: name}
+					ss := snapshotter.New(m)
+					ss.SnapshotDir = "snapshots"
+					ss.FileName = snapshotter.NestedFileName
+					ss.SnapshotBytes("value", []byte{0})
+					ss.Verify()
+					errors = append(errors, m.errors...)
+				}
+				return errors
+			},
+			snapshots: []string{
+				"snapshots/MockTest.snapshots.json",
+				"snapshots/MockTest/files/value.bin",
+				"snapshots/MockTest/case.snapshots.json",
+				"snapshots/MockTest/case/files/value.bin",
+			},
+		},
+	}
+
+	// Pretend all tests are run, even if only this test is or tests run in
+	// short mode.
+	runFlag := flag.Lookup("test.run")
+	previousRun := runFlag.Value.String()
+	if err := runFlag.Value.Set(""); err != nil {
+		t.Fatal(err)
+	}
+	defer runFlag.Value.Set(previousRun)
+	shortFlag := flag.Lookup("test.short")
+	previousShort := shortFlag.Value.String()
+	if err := shortFlag.Value.Set("false"); err != nil {
+		t.Fatal(err)
+	}
+	defer shortFlag.Value.Set(previousShort)
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			switchToTempWorkingDir(t)
+			for _, name := range append(tc.obsolete, tc.fixtures...) {
+				if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(name, []byte("{}"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			setRewriteSnapshotsEnv(t)
+			if errors := tc.run(); len(errors) != 0 {
+				t.Fatalf("unexpected errors rewriting snapshots: %v", errors)
+			}
+
+			var errors []string
+			run := mockM{run: func() {
+				errors = append(errors, tc.run()...)
+			}}
+
+			// Nothing is deleted when checking snapshots.
+			t.Setenv("REWRITE_SNAPSHOTS", "0")
+			if code := snapshotter.Main(run); code != 0 || len(errors) != 0 {
+				t.Fatalf("unexpected failure: %d %v", code, errors)
+			}
+			kept := append(tc.snapshots, tc.fixtures...)
+			assertFiles(t, tc.dir, append(kept, tc.obsolete...)...)
+
+			t.Setenv("REWRITE_SNAPSHOTS", "1")
+			if code := snapshotter.Main(run); code != 0 || len(errors) != 0 {
+				t.Fatalf("unexpected failure: %d %v", code, errors)
+			}
+			assertFiles(t, tc.dir, kept...)
+		})
+	}
+}
+
+func TestSnapshotFileNames(t *testing.T) {
+	testCases := []struct {
+		name     string
+		fileName snapshotter.FileNameFunc
+		dir      string
+		// expected is the snapshot file, relative to pkg/server.
+		expected string
+	}{
+		{name: "default", expected: "testdata/MockTest-case_1_extra.snapshots.json"},
+		{name: "nested", fileName: snapshotter.NestedFileName, dir: "snapshots", expected: "snapshots/MockTest/case_1_extra.snapshots.json"},
+		{name: "package", fileName: snapshotter.PackageFileName(snapshotter.FlatFileName), dir: "../../snapshots", expected: "../../snapshots/pkg/server/MockTest-case_1_extra.snapshots.json"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			switchToTempWorkingDir(t)
+			if err := ioutil.WriteFile("go.mod", []byte("module example.com/snapshots\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.MkdirAll("pkg/server", 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chdir("pkg/server"); err != nil {
+				t.Fatal(err)
+			}
+			defer os.Chdir("../..")
+
+			setRewriteSnapshotsEnv(t)
+			m := &mockCleanupT{name: "MockTest/case 1"}
+			ss := snapshotter.NewNamed(m, "extra")
+			ss.SnapshotDir = tc.dir
+			ss.FileName = tc.fileName
+			if name := ss.SnapshotFileName(); name != filepath.FromSlash(tc.expected) {
+				t.Errorf("expected snapshot file %s, got %s", tc.expected, name)
+			}
+			ss.Snapshot("value", 1)
+			ss.Verify()
+			if len(m.errors) != 0 {
+				t.Errorf("unexpected errors: %v", m.errors)
+			}
+			assertFiles(t, "../..", "../../go.mod", path.Join("../../pkg/server", tc.expected))
+		})
+	}
+}
+
+func TestPendingChanges(t *testing.T) {
+	type step struct {
+		accept bool
+		// names are the snapshots to resolve, or nil for the whole change.
+		names []string
+		// pending are the snapshots still pending afterwards.
+		pending []string
+		// files are the files in testdata afterwards.
+		files []string
+	}
+	testCases := []struct {
+		name  string
+		steps []step
+		// text, value and old are the snapshots that match afterwards.
+		text  string
+		value int
+		old   bool
+	}{
+		{
+			name:  "accept",
+			steps: []step{{accept: true, files: []string{"testdata/MockTest.snapshots.json", "testdata/MockTest/text.txt"}}},
+			text:  "a\nc\n",
+			value: 2,
+		},
+		{
+			name:  "reject",
+			steps: []step{{files: []string{"testdata/MockTest.snapshots.json", "testdata/MockTest/text.txt"}}},
+			text:  "a\nb\n",
+			value: 1,
+			old:   true,
+		},
+		{
+			name: "accept one by one",
+			steps: []step{
+				{accept: true, names: []string{"text"}, pending: []string{"value", "old"}, files: []string{"testdata/MockTest.snapshots.json", "testdata/MockTest.snapshots.json.new", "testdata/MockTest/text.txt"}},
+				{accept: true, names: []string{"value", "old"}, files: []string{"testdata/MockTest.snapshots.json", "testdata/MockTest/text.txt"}},
+			},
+			text:  "a\nc\n",
+			value: 2,
+		},
+		{
+			name: "reject one and accept the others",
+			steps: []step{
+				{names: []string{"value"}, pending: []string{"text", "old"}, files: []string{"testdata/MockTest.snapshots.json", "testdata/MockTest.snapshots.json.new", "testdata/MockTest/text.txt", "testdata/MockTest/text.txt.new"}},
+				{accept: true, names: []string{"text", "old"}, files: []string{"testdata/MockTest.snapshots.json", "testdata/MockTest/text.txt"}},
+			},
+			text:  "a\nc\n",
+			value: 1,
+		},
+		{
+			name: "accept one and then all",
+			steps: []step{
+				{accept: true, names: []string{"text"}, pending: []string{"value", "old"}, files: []string{"testdata/MockTest.snapshots.json", "testdata/MockTest.snapshots.json.new", "testdata/MockTest/text.txt"}},
+				{accept: true, files: []string{"testdata/MockTest.snapshots.json", "testdata/MockTest/text.txt"}},
+			},
+			text:  "a\nc\n",
+			value: 2,
+		},
+		{
+			name: "reject one and then all",
+			steps: []step{
+				{names: []string{"text"}, pending: []string{"value", "old"}, files: []string{"testdata/MockTest.snapshots.json", "testdata/MockTest.snapshots.json.new", "testdata/MockTest/text.txt"}},
+				{files: []string{"testdata/MockTest.snapshots.json", "testdata/MockTest/text.txt"}},
+			},
+			text:  "a\nb\n",
+			value: 1,
+			old:   true,
+		},
+	}
+
+	takeSnapshots := func(text string, value int, old bool) func(ss *snapshotter.Snapshotter) {
+		return func(ss *snapshotter.Snapshotter) {
+			ss.TextFiles = true
+			ss.Snapshot("text", text)
+			ss.Snapshot("value", value)
+			if old {
+				ss.Snapshot("old", 0)
+			}
+		}
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			switchToTempWorkingDir(t)
+			runSnapshotSteps(t,
+				snapshotStep{env: "REWRITE_SNAPSHOTS", take: takeSnapshots("a\nb\n", 1, true)},
+				snapshotStep{
+					take:   takeSnapshots("a\nc\n", 2, false),
+					errors: []string{"snapshot text differs", "snapshot value differs", "1 missing: old", "The new snapshots were written to testdata/MockTest.snapshots.json.new"},
+				},
+			)
+			assertFiles(t, "testdata",
+				"testdata/MockTest.snapshots.json",
+				"testdata/MockTest.snapshots.json.new",
+				"testdata/MockTest/text.txt",
+				"testdata/MockTest/text.txt.new",
+			)
+
+			changes, err := snapshotter.FindPendingChanges("testdata")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(changes) != 1 || changes[0].SnapshotFile != "testdata/MockTest.snapshots.json" {
+				t.Fatalf("expected one pending change, got %v", changes)
+			}
+			diff, err := changes[0].Diff()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, expected := range []string{"testdata/MockTest/text.txt:\n", "-b\n+c\n", "-      1\n", "+      2\n"} {
+				if !strings.Contains(diff, expected) {
+					t.Errorf("expected diff to contain %q, got:\n%s", expected, diff)
+				}
+			}
+
+			for i, step := range tc.steps {
+				// Changes can be found by the pending snapshot file as well.
+				change, err := snapshotter.PendingChangeOf("testdata/MockTest.snapshots.json.new")
+				if err != nil {
+					t.Fatal(err)
+				}
+				switch {
+				case step.accept && step.names == nil:
+					err = change.Accept()
+				case step.accept:
+					err = change.AcceptSnapshots(step.names...)
+				case step.names == nil:
+					err = change.Reject()
+				default:
+					err = change.RejectSnapshots(step.names...)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				var pending []string
+				if step.pending != nil {
+					if pending, err = change.Snapshots(); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if strings.Join(pending, ", ") != strings.Join(step.pending, ", ") {
+					t.Errorf("step %d: expected pending snapshots %v, got %v", i, step.pending, pending)
+				}
+				assertFiles(t, "testdata", step.files...)
+			}
+
+			if changes, err := snapshotter.FindPendingChanges("testdata"); err != nil || len(changes) != 0 {
+				t.Errorf("expected the change to be resolved, got %v %v", changes, err)
+			}
+			if _, err := snapshotter.PendingChangeOf("testdata/MockTest.snapshots.json"); err == nil {
+				t.Errorf("expected the resolved change not to be pending")
+			}
+			runSnapshotSteps(t, snapshotStep{take: takeSnapshots(tc.text, tc.value, tc.old)})
+		})
+	}
+
+	switchToTempWorkingDir(t)
+	runSnapshotSteps(t,
+		snapshotStep{env: "REWRITE_SNAPSHOTS", take: func(ss *snapshotter.Snapshotter) { ss.Snapshot("value", 1) }},
+		snapshotStep{take: func(ss *snapshotter.Snapshotter) { ss.Snapshot("value", 2) }, errors: []string{"snapshot value differs", "1 differing: value", rewriteHint}},
+	)
+	change, err := snapshotter.PendingChangeOf("testdata/MockTest.snapshots.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := change.AcceptSnapshots("missing"); err == nil || !strings.Contains(err.Error(), `has no snapshot named "missing"`) {
+		t.Errorf("expected error for unknown snapshot, got %v", err)
+	}
+}
+
+func TestLint(t *testing.T) {
+	snapshotsA := `[{"Name": "a", "Values": [1]}, {"Name": "a", "Values": ["` + strings.Repeat("x", 100) + `"]}, {"Name": "b", "File": "TestA/b.txt"}]`
+	testCases := []struct {
+		file     string
+		contents string
+		options  snapshotter.LintOptions
+		// problems are substrings of the problems reported, in order.
+		problems []string
+		// formatted is set if Lint rewrites the file in its canonical format.
+		formatted bool
+	}{
+		{
+			file:     "testdata/TestA.snapshots.json",
+			contents: snapshotsA,
+			options:  snapshotter.LintOptions{MaxSnapshotSize: 100, Fix: true},
+			problems: []string{
+				"testdata/TestA.snapshots.json: snapshot a: duplicate snapshot name.",
+				"testdata/TestA.snapshots.json: snapshot a: snapshot is 159 bytes, more than the maximum of 100 bytes",
+				"testdata/TestA.snapshots.json: snapshot b: stat testdata/TestA/b.txt: no such file or directory",
+			},
+			formatted: true,
+		},
+		{
+			file:     "testdata/TestA.snapshots.json",
+			contents: snapshotsA,
+			problems: []string{
+				"snapshot a: duplicate snapshot name.",
+				"snapshot b: stat testdata/TestA/b.txt: no such file or directory",
+				"testdata/TestA.snapshots.json: snapshot file is not formatted canonically",
+			},
+		},
+		{
+			file:     "testdata/TestB.snapshots.json",
+			contents: `{`,
+			options:  snapshotter.LintOptions{Fix: true},
+			problems: []string{"error unmarshaling snapshots"},
+		},
+		{
+			file:     "testdata/nested/TestC.snapshots.txt",
+			contents: "=== c\n1\n",
+		},
+		{
+			file:     "testdata/nested/TestC.snapshots.txt",
+			contents: "\n=== c\n1\n",
+			problems: []string{"not formatted canonically"},
+		},
+		{
+			// Snapshot files with malformed entries are reported, and not
+			// formatted, which would drop the unknown fields.
+			file:     "testdata/TestD.snapshots.json",
+			contents: `[{"Name": "d", "Values": [1], "Extra": true}, null, {"Name": "e", "Values": [2]}]`,
+			options:  snapshotter.LintOptions{Fix: true},
+			problems: []string{
+				`testdata/TestD.snapshots.json: malformed entry 0: json: unknown field "Extra"`,
+				"testdata/TestD.snapshots.json: malformed entry 1: not a snapshot",
+			},
+		},
+		{
+			file:     "testdata/TestE.snapshots.yaml",
+			contents: "- name: e\n  values: [1]\n  extra: 1\n",
+			problems: []string{"malformed entry: line 3: field extra not found"},
+		},
+	}
+
+	lint := func(name string, options snapshotter.LintOptions) []string {
+		t.Helper()
+		problems, err := snapshotter.Lint(name, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var messages []string
+		for _, problem := range problems {
+			messages = append(messages, problem.String())
+		}
+		return messages
+	}
+
+	switchToTempWorkingDir(t)
+	for _, tc := range testCases {
+		t.Run(tc.file, func(t *testing.T) {
+			if err := os.RemoveAll("testdata"); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.MkdirAll(filepath.Dir(tc.file), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(tc.file, []byte(tc.contents), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			problems := lint(tc.file, tc.options)
+			if len(problems) != len(tc.problems) {
+				t.Errorf("expected problems %q, got %q", tc.problems, problems)
+			} else {
+				for i, expected := range tc.problems {
+					if !strings.Contains(problems[i], expected) {
+						t.Errorf("expected problem %q, got %q", expected, problems[i])
+					}
+				}
+			}
+
+			assertFiles(t, "testdata", tc.file)
+			info, err := os.Stat(tc.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode().Perm() != 0600 {
+				t.Errorf("expected Lint to keep mode 0600, got %v", info.Mode().Perm())
+			}
+			data, err := ioutil.ReadFile(tc.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tc.formatted {
+				if string(data) != tc.contents {
+					t.Errorf("expected snapshot file to be kept, got %s", data)
+				}
+				return
+			}
+			if string(data) == tc.contents {
+				t.Errorf("expected snapshot file to be formatted")
+			}
+			for _, problem := range lint(tc.file, snapshotter.LintOptions{}) {
+				if strings.Contains(problem, "not formatted canonically") {
+					t.Errorf("expected formatted snapshot file, got %s", problem)
+				}
+			}
+		})
+	}
+
+	// Only snapshot files are linted.
+	for _, tc := range testCases {
+		if err := os.MkdirAll(filepath.Dir(tc.file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(tc.file, []byte(tc.contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile("testdata/fixture.json", []byte(`{`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	names, err := snapshotter.FindSnapshotFiles(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "testdata/TestA.snapshots.json, testdata/TestB.snapshots.json, testdata/TestD.snapshots.json, testdata/TestE.snapshots.yaml, testdata/nested/TestC.snapshots.txt"; strings.Join(names, ", ") != expected {
+		t.Errorf("expected snapshot files %s, got %s", expected, strings.Join(names, ", "))
+	}
+}
+
+func TestSizeLimit(t *testing.T) {
+	switchToTempWorkingDir(t)
+	setRewriteSnapshotsEnv(t)
+	type response struct {
+		Status int
+		Body   struct{ Text string }
+	}
+	var large response
+	large.Body.Text = strings.Repeat("x", 200)
+
+	testCases := []struct {
+		name     string
+		limit    snapshotter.SizeLimit
+		expected string
+	}{
+		{
+			name:     "snapshot",
+			limit:    snapshotter.SizeLimit{Snapshot: 200},
+			expected: `snapshot large is 340 bytes, more than the limit of 200 bytes. Snapshot only the values the test is about, or ignore large fields with Matchers such as snapshotter.Ignore("$.Values[0].Body.Text").`,
+		},
+		{
+			name:     "file",
+			limit:    snapshotter.SizeLimit{File: 300},
+			expected: "snapshots in testdata/MockTest.snapshots.json are 402 bytes, more than the limit of 300 bytes. The largest snapshots are large (340 bytes), small (62 bytes).",
+		},
+		{
+			name:  "warning",
+			limit: snapshotter.SizeLimit{Snapshot: 200, Warn: true},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			os.RemoveAll("testdata")
+			var m mockT
+			ss := snapshotter.New(&m)
+			ss.SizeLimit = tc.limit
+			ss.Snapshot("small", 1)
+			ss.Snapshot("large", large)
+			ss.Verify()
+
+			_, err := os.Stat("testdata/MockTest.snapshots.json")
+			if tc.expected == "" {
+				if len(m.errors) != 0 || err != nil {
+					t.Errorf("expected snapshots to be written with a warning, got %v %v", m.errors, err)
+				}
+				return
+			}
+			if len(m.errors) != 1 || m.errors[0] != tc.expected {
+				t.Errorf("expected error %q, got %v", tc.expected, m.errors)
+			}
+			if !os.IsNotExist(err) {
+				t.Errorf("expected snapshots exceeding the limit not to be written")
+			}
+		})
+	}
+}
+
+func TestMainKeepsSnapshotsOfSkippedTests(t *testing.T) {
+	runFlag := flag.Lookup("test.run")
+	previousRun := runFlag.Value.String()
+	if err := runFlag.Value.Set(""); err != nil {
+		t.Fatal(err)
+	}
+	defer runFlag.Value.Set(previousRun)
+	shortFlag := flag.Lookup("test.short")
+	previousShort := shortFlag.Value.String()
+	defer shortFlag.Value.Set(previousShort)
+
+	testCases := []struct {
+		name  string
+		short bool
+		skip  bool
+	}{
+		{name: "short", short: true},
+		{name: "skipped", skip: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			switchToTempWorkingDir(t)
+			setRewriteSnapshotsEnv(t)
+			if err := shortFlag.Value.Set(fmt.Sprint(tc.short)); err != nil {
+				t.Fatal(err)
+			}
+			files := []string{"testdata/TestSkippedEarly.snapshots.json", "testdata/TestSkipped.snapshots.json"}
+			for _, name := range files {
+				if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(name, []byte("[]"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			run := mockM{run: func() {
+				m := &mockCleanupT{name: "TestSkipped", skipped: tc.skip}
+				ss := snapshotter.New(m)
+				ss.Snapshot("value", 1)
+				if !tc.skip {
+					ss.Verify()
+				}
+				m.finish()
+				if len(m.errors) != 0 {
+					t.Errorf("unexpected errors: %v", m.errors)
+				}
+			}}
+			if code := snapshotter.Main(run); code != 0 {
+				t.Fatalf("unexpected failure: %d", code)
+			}
+			for _, name := range files {
+				if _, err := os.Stat(name); err != nil {
+					t.Errorf("expected %s to be kept: %s", name, err)
+				}
+			}
+		})
+	}
+}
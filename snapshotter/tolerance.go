@@ -0,0 +1,126 @@
+package snapshotter
+
+import (
+	"math"
+	"reflect"
+	"sort"
+)
+
+// FloatTolerance configures how much numbers in snapshots may differ from the
+// expected numbers. Two numbers are equal if they are within either the
+// absolute or the relative tolerance. The zero value requires numbers to match
+// exactly.
+type FloatTolerance struct {
+	// Absolute is the largest allowed absolute difference.
+	Absolute float64
+	// Relative is the largest allowed difference relative to the magnitude of
+	// the expected number.
+	Relative float64
+}
+
+// within reports whether actual is within the tolerance of expected.
+func (t FloatTolerance) within(expected, actual float64) bool {
+	delta := math.Abs(actual - expected)
+	return delta <= t.Absolute || delta <= t.Relative*math.Abs(expected)
+}
+
+// pathTolerance is a FloatTolerance for the numbers at a JSON path.
+type pathTolerance struct {
+	path      jsonPath
+	tolerance FloatTolerance
+}
+
+// comparer compares JSON values, allowing numbers to differ within the
+// configured tolerances.
+type comparer struct {
+	tolerance      FloatTolerance
+	pathTolerances []pathTolerance
+}
+
+// newComparer returns a comparer using the tolerances configured on s. Path
+// tolerances are ordered from the most to the least specific path.
+func (s *Snapshotter) newComparer() (*comparer, error) {
+	c := &comparer{tolerance: s.FloatTolerance}
+	for path, tolerance := range s.PathFloatTolerances {
+		parsed, err := parsePath(path)
+		if err != nil {
+			return nil, err
+		}
+		c.pathTolerances = append(c.pathTolerances, pathTolerance{path: parsed, tolerance: tolerance})
+	}
+	sort.Slice(c.pathTolerances, func(i, j int) bool {
+		return moreSpecific(c.pathTolerances[i].path, c.pathTolerances[j].path)
+	})
+	return c, nil
+}
+
+// moreSpecific reports whether the path p is more specific than q: it has
+// fewer wildcards, or as many wildcards with the first one further right.
+// Other paths are ordered by their text, so the order is always the same.
+func moreSpecific(p, q jsonPath) bool {
+	if pw, qw := p.wildcards(), q.wildcards(); pw != qw {
+		return pw < qw
+	}
+	for i := 0; i < len(p) && i < len(q); i++ {
+		if p[i].wildcard != q[i].wildcard {
+			return !p[i].wildcard
+		}
+	}
+	return p.String() < q.String()
+}
+
+// toleranceAt returns the tolerance for numbers at path, from the most
+// specific path tolerance matching it.
+func (c *comparer) toleranceAt(path jsonPath) FloatTolerance {
+	for _, pathTolerance := range c.pathTolerances {
+		if pathTolerance.path.matches(path) {
+			return pathTolerance.tolerance
+		}
+	}
+	return c.tolerance
+}
+
+// numbersEqual reports whether two numbers at path are equal within the
+// tolerance.
+func (c *comparer) numbersEqual(path jsonPath, expected, actual float64) bool {
+	return expected == actual || c.toleranceAt(path).within(expected, actual)
+}
+
+// equal reports whether two JSON values at path are equal.
+func (c *comparer) equal(path jsonPath, expected, actual interface{}) bool {
+	switch e := expected.(type) {
+	case float64:
+		a, ok := actual.(float64)
+		return ok && c.numbersEqual(path, e, a)
+	case map[string]interface{}:
+		a, ok := actual.(map[string]interface{})
+		if !ok || len(a) != len(e) {
+			return false
+		}
+		for key, value := range e {
+			other, ok := a[key]
+			if !ok || !c.equal(path.child(keySegment(key)), value, other) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		a, ok := actual.([]interface{})
+		if !ok || len(a) != len(e) {
+			return false
+		}
+		for i := range e {
+			if !c.equal(path.child(indexSegment(i)), e[i], a[i]) {
+				return false
+			}
+		}
+		return true
+	default:
+		return reflect.DeepEqual(expected, actual)
+	}
+}
+
+// valuesEqual reports whether the values of two snapshots are equal.
+func (c *comparer) valuesEqual(expected, actual []interface{}) bool {
+	return c.equal(valuesPath, toJSONValue(expected), toJSONValue(actual))
+}
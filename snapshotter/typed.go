@@ -0,0 +1,219 @@
+package snapshotter
+
+import (
+	"encoding"
+	"encoding/base64"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// typeKey is the key of the Go type name in objects of typed snapshots.
+	typeKey = "$type"
+	// valueKey is the key of the value in objects of typed snapshots that wrap
+	// a value that is not an object.
+	valueKey = "$value"
+	// encodingKey is the key of the encoding of a "$value" that is not stored
+	// as is, such as "base64" for binary byte slices.
+	encodingKey = "$encoding"
+
+	// maxExactInteger is the largest integer that float64, and so JSON
+	// numbers as they are compared, can hold exactly.
+	maxExactInteger = 1 << 53
+)
+
+// TypedSerializer returns a Serializer that records the Go types of values
+// alongside the values, and stores them using serializer. Values are not
+// marshaled with encoding/json, so custom MarshalJSON methods don't hide what
+// actually came out:
+//
+//   - Structs and maps are stored as objects with a "$type" key holding their
+//     type name. Struct fields are stored by their Go names, and map keys are
+//     formatted with fmt.
+//   - Values of named types and of numeric types other than int and float64,
+//     such as time.Duration or uint8, are stored as objects with a "$type" and
+//     a "$value" key. Values implementing encoding.TextMarshaler, such as
+//     time.Time, and byte slices are stored as text in "$value". Byte slices
+//     that are not valid UTF-8 are stored as base64, with an "$encoding" key.
+//   - Integers too large to be stored exactly as JSON numbers are stored as
+//     strings in "$value".
+//   - Pointers are recorded in the type of the value pointed to, which is
+//     stored as an object with a "$type" and a "$value" key if it doesn't
+//     record its type already, so a pointer to 1 differs from 1. Nil pointers
+//     are stored with a null "$value".
+//   - Nil slices and maps are stored as null, so they differ from empty
+//     slices and maps.
+//   - Map keys starting with "$" are stored with another "$" in front, so they
+//     don't collide with "$type".
+//
+// Only exported struct fields are recorded.
+func TypedSerializer(serializer Serializer) Serializer {
+	return typedSerializer{Serializer: serializer}
+}
+
+type typedSerializer struct {
+	Serializer
+}
+
+func (s typedSerializer) Encode(value interface{}) (interface{}, error) {
+	typed, err := encodeTyped(reflect.ValueOf(value), make(map[uintptr]bool))
+	if err != nil {
+		return nil, err
+	}
+	return s.Serializer.Encode(typed)
+}
+
+var textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+
+// encodeTyped encodes v as a JSON value annotated with Go type names. visiting
+// holds the pointers being encoded, to detect cycles.
+func encodeTyped(v reflect.Value, visiting map[uintptr]bool) (interface{}, error) {
+	if !v.IsValid() {
+		return nil, nil
+	}
+	t := v.Type()
+
+	if t.Implements(textMarshalerType) && v.CanInterface() && !isNil(v) {
+		text, err := v.Interface().(encoding.TextMarshaler).MarshalText()
+		if err != nil {
+			return nil, err
+		}
+		return typedValue(t, string(text)), nil
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return typedValue(t, nil), nil
+		}
+		if visiting[v.Pointer()] {
+			return nil, fmt.Errorf("cycle through %s", t)
+		}
+		visiting[v.Pointer()] = true
+		defer delete(visiting, v.Pointer())
+		encoded, err := encodeTyped(v.Elem(), visiting)
+		if err != nil {
+			return nil, err
+		}
+		// Record the pointer in the type of the value pointed to, or wrap
+		// values that don't record their type.
+		if object, ok := encoded.(map[string]interface{}); ok {
+			object[typeKey] = t.String()
+			return object, nil
+		}
+		return typedValue(t, encoded), nil
+
+	case reflect.Interface:
+		if v.IsNil() {
+			return nil, nil
+		}
+		return encodeTyped(v.Elem(), visiting)
+
+	case reflect.Struct:
+		object := map[string]interface{}{typeKey: t.String()}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.PkgPath != "" {
+				continue
+			}
+			encoded, err := encodeTyped(v.Field(i), visiting)
+			if err != nil {
+				return nil, fmt.Errorf("%s.%s: %s", t, field.Name, err)
+			}
+			object[field.Name] = encoded
+		}
+		return object, nil
+
+	case reflect.Map:
+		if v.IsNil() {
+			return nil, nil
+		}
+		object := map[string]interface{}{typeKey: t.String()}
+		for _, key := range v.MapKeys() {
+			name := fmt.Sprint(key)
+			if strings.HasPrefix(name, "$") {
+				name = "$" + name
+			}
+			if _, ok := object[name]; ok {
+				return nil, fmt.Errorf("%s: duplicate key %q", t, name)
+			}
+			encoded, err := encodeTyped(v.MapIndex(key), visiting)
+			if err != nil {
+				return nil, fmt.Errorf("%s[%s]: %s", t, name, err)
+			}
+			object[name] = encoded
+		}
+		return object, nil
+
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return nil, nil
+		}
+		if t.Elem().Kind() == reflect.Uint8 && v.Kind() == reflect.Slice {
+			if utf8.Valid(v.Bytes()) {
+				return typedValue(t, string(v.Bytes())), nil
+			}
+			typed := typedValue(t, base64.StdEncoding.EncodeToString(v.Bytes()))
+			typed[encodingKey] = "base64"
+			return typed, nil
+		}
+		array := make([]interface{}, 0, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			encoded, err := encodeTyped(v.Index(i), visiting)
+			if err != nil {
+				return nil, fmt.Errorf("[%d]: %s", i, err)
+			}
+			array = append(array, encoded)
+		}
+		if t.Name() != "" {
+			return typedValue(t, array), nil
+		}
+		return array, nil
+
+	case reflect.Bool:
+		return typedBasic(t, reflect.TypeOf(false), v.Bool()), nil
+	case reflect.String:
+		return typedBasic(t, reflect.TypeOf(""), v.String()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if i := v.Int(); i > maxExactInteger || i < -maxExactInteger {
+			return typedValue(t, strconv.FormatInt(i, 10)), nil
+		}
+		return typedBasic(t, reflect.TypeOf(0), float64(v.Int())), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if u := v.Uint(); u > maxExactInteger {
+			return typedValue(t, strconv.FormatUint(u, 10)), nil
+		}
+		return typedValue(t, float64(v.Uint())), nil
+	case reflect.Float32, reflect.Float64:
+		return typedBasic(t, reflect.TypeOf(0.0), v.Float()), nil
+
+	default:
+		return nil, fmt.Errorf("unsupported value of type %s", t)
+	}
+}
+
+// isNil reports whether v is a nil pointer, interface, map or slice.
+func isNil(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface, reflect.Map, reflect.Slice:
+		return v.IsNil()
+	}
+	return false
+}
+
+// typedBasic returns value as is if t is the plain type, and as a typed value
+// otherwise.
+func typedBasic(t, plain reflect.Type, value interface{}) interface{} {
+	if t == plain {
+		return value
+	}
+	return typedValue(t, value)
+}
+
+// typedValue wraps value in an object recording its type.
+func typedValue(t reflect.Type, value interface{}) map[string]interface{} {
+	return map[string]interface{}{typeKey: t.String(), valueKey: value}
+}